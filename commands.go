@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ivampiresp/smtp-queue/config"
+	"github.com/ivampiresp/smtp-queue/db"
+)
+
+// 命令行子命令的用法说明
+const usage = `用法:
+  smtp-queue                  启动SMTP队列服务器
+  smtp-queue migrate status   查看数据库结构迁移状态
+  smtp-queue migrate up       执行尚未执行的数据库结构迁移
+  smtp-queue queue list       列出队列中的邮件`
+
+// runCommand 执行命令行子命令
+func runCommand(cfg *config.Config, args []string) error {
+	if len(args) == 2 && args[0] == "queue" && args[1] == "list" {
+		return queueList(cfg)
+	}
+	if len(args) == 2 && args[0] == "migrate" {
+		switch args[1] {
+		case "status":
+			return migrateStatus(cfg)
+		case "up":
+			return migrateUp(cfg)
+		}
+	}
+	fmt.Fprintln(os.Stderr, usage)
+	return fmt.Errorf("未知的命令: %s", strings.Join(args, " "))
+}
+
+// openStore 按配置打开队列存储
+func openStore(cfg *config.Config) (db.Store, error) {
+	path := cfg.DBPath
+	switch cfg.QueueStore {
+	case db.StoreSpool:
+		path = cfg.SpoolDir
+	case db.StorePostgres:
+		path = cfg.PostgresDSN
+	}
+	return db.OpenStore(cfg.QueueStore, path)
+}
+
+// openMigrator 按配置打开需要结构迁移的存储（不执行迁移），同时返回用于显示的数据库名称
+func openMigrator(cfg *config.Config) (db.Migrator, string, error) {
+	switch cfg.QueueStore {
+	case db.StoreSQLite:
+		database, err := db.Open(cfg.DBPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return database, cfg.DBPath, nil
+	case db.StorePostgres:
+		// 连接字符串中可能包含密码，不显示
+		database, err := db.ConnectPostgres(cfg.PostgresDSN)
+		if err != nil {
+			return nil, "", err
+		}
+		return database, "PostgreSQL", nil
+	default:
+		return nil, "", fmt.Errorf("只有SQLite和PostgreSQL队列存储需要结构迁移，当前为 %s", cfg.QueueStore)
+	}
+}
+
+// 打印队列中的邮件
+func queueList(cfg *config.Config) error {
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	emails, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "队列标识\t入队时间\t发件人\t收件人\t失败次数\t租约\t最后错误")
+	for _, email := range emails {
+		from := email.From
+		if from == "" {
+			from = "<>"
+		}
+		lease := ""
+		if email.LeaseOwner != "" {
+			lease = email.LeaseOwner
+			if email.LeaseUntil != nil {
+				lease += " 至 " + email.LeaseUntil.Local().Format("2006-01-02 15:04:05")
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			email.QueueID,
+			email.Created.Local().Format("2006-01-02 15:04:05"),
+			from,
+			strings.Join(email.To, ","),
+			email.FailCount,
+			lease,
+			email.LastError,
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n共%d封邮件\n", len(emails))
+	return nil
+}
+
+// 打印每个迁移的执行状态
+func migrateStatus(cfg *config.Config) error {
+	database, name, err := openMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	status, err := database.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "版本\t名称\t状态\t执行时间")
+	pending := 0
+	for _, m := range status {
+		state, appliedAt := "未执行", ""
+		if m.Applied {
+			state = "已执行"
+			if !m.AppliedAt.IsZero() {
+				appliedAt = m.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+		} else {
+			pending++
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", m.Version, m.Name, state, appliedAt)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n数据库: %s，共%d个迁移，%d个未执行\n", name, len(status), pending)
+	return nil
+}
+
+// 执行尚未执行的迁移
+func migrateUp(cfg *config.Config) error {
+	database, _, err := openMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	count, err := database.Migrate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("已执行%d个迁移\n", count)
+	return nil
+}
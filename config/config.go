@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
@@ -9,21 +11,109 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// 监听器加密模式
+const (
+	ListenerModePlain    = "plain"    // 明文，不提供STARTTLS
+	ListenerModeStartTLS = "starttls" // 明文连接，配置证书后提供STARTTLS
+	ListenerModeTLS      = "tls"      // 隐式TLS（SMTPS），从第一个字节开始加密
+	ListenerModeLMTP     = "lmtp"     // LMTP（RFC 2033），供本地投递代理使用
+)
+
+// ListenerConfig 描述一个SMTP监听器
+type ListenerConfig struct {
+	Addr string
+	Mode string
+
+	// 是否要求连接以HAProxy PROXY协议头开始（v1或v2）
+	ProxyProtocol bool
+}
+
 // Config 包含应用程序的配置
 type Config struct {
 	// SMTP服务器监听地址
 	ListenAddr string
 
+	// 全部监听器，未配置LISTENERS时仅包含LISTEN_ADDR
+	Listeners []ListenerConfig
+
+	// Unix域套接字监听器的文件权限和属主（"用户[:组]"，为空时不修改）
+	UnixSocketMode  os.FileMode
+	UnixSocketOwner string
+
+	// SMTP服务器对外宣告的主机名，用于欢迎消息和EHLO响应
+	Hostname string
+
+	// 入站TLS配置
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSRequired bool // 是否要求客户端在MAIL FROM之前完成STARTTLS
+
+	// 入站认证配置
+	AuthUsersFile     string // htpasswd格式的bcrypt凭据文件
+	AuthRequired      bool   // 是否要求客户端在MAIL FROM之前完成AUTH
+	AllowInsecureAuth bool   // 是否允许在未加密的TCP连接上认证，默认只在TLS或Unix套接字上提供AUTH
+	MaxAuthFailures   int    // 单个会话允许的认证失败次数，达到后断开连接，0表示不限制
+
+	// 访问控制
+	AllowedNetworks []netip.Prefix // 允许连接的网段，为空时允许所有地址
+	DeniedNetworks  []netip.Prefix // 拒绝连接的网段，优先于允许列表
+	TrustedNetworks []netip.Prefix // 受信任网段，无需认证即可投递（类似Postfix的mynetworks）
+	TrustedProxies  []netip.Prefix // 允许发送PROXY协议头的负载均衡器网段
+
+	// 发件人和收件人策略
+	PolicyFile    string // 策略规则文件，为空时接受所有地址
+	MaxRecipients int    // 单封邮件的最大收件人数，0表示不限制
+
+	// 会话超时（RFC 5321 4.5.3.2），每条命令或每个数据块重新计时
+	GreetingTimeout        time.Duration // 欢迎消息之后等待HELO/EHLO
+	MailTimeout            time.Duration // 事务之外等待MAIL等命令
+	RcptTimeout            time.Duration // 事务之中等待RCPT、DATA等命令
+	DataBlockTimeout       time.Duration // 接收邮件内容时等待下一个数据块
+	DataTerminationTimeout time.Duration // 邮件内容结束后处理邮件并发出响应
+
+	// 连接数限制，0表示不限制
+	MaxConnections      int // 全局最大并发连接数
+	MaxConnectionsPerIP int // 单个IP地址的最大并发连接数
+
+	// 投递速率限制（每分钟），认证客户端按用户计数，其余按IP地址计数，0表示不限制
+	MessageRateLimit   int
+	RecipientRateLimit int
+
+	// 单封邮件的最大字节数，0表示不限制。入队和投递时整封邮件会读入内存，
+	// 该值同时限制了每封邮件占用的内存
+	MaxMessageSize int64
+
+	// 队列存储类型: sqlite、memory、spool、postgres
+	QueueStore string
+
 	// 数据库文件路径
 	DBPath string
 
+	// spool存储的目录
+	SpoolDir string
+
+	// PostgreSQL连接字符串
+	PostgresDSN string
+
 	// 队列处理间隔
 	QueueInterval time.Duration
 
+	// 工作者标识，取出邮件时作为租约的持有者，多个实例共享队列时必须各不相同
+	WorkerID string
+
+	// 取出邮件的租约时长，超过该时间仍未完成投递的邮件会被放回队列
+	LeaseDuration time.Duration
+
+	// 投递一封邮件（连接上游到发送完成）的最长时间，必须小于租约时长
+	DeliveryTimeout time.Duration
+
 	// 邮件清理配置
 	MaxEmailAge  time.Duration
 	MaxFailCount int
 
+	// 邮件延迟超过该时间后向发件人发送延迟通知，0表示不发送
+	DelayWarningTime time.Duration
+
 	// SMTP服务器配置
 	SMTPHost       string
 	SMTPPort       int
@@ -54,6 +144,11 @@ func Load() (*Config, error) {
 		maxFailCount = 5
 	}
 
+	delayWarningTime, err := strconv.Atoi(getEnv("DELAY_WARNING_TIME", "4"))
+	if err != nil {
+		delayWarningTime = 4
+	}
+
 	smtpPort, err := strconv.Atoi(getEnv("SMTP_PORT", "587"))
 	if err != nil {
 		smtpPort = 587
@@ -71,21 +166,238 @@ func Load() (*Config, error) {
 		smtpEncryption = "none"
 	}
 
+	// 获取主机名
+	hostname := getEnv("SERVER_HOSTNAME", "")
+	if hostname == "" {
+		hostname, err = os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "localhost"
+		}
+	}
+
+	tlsRequired, err := strconv.ParseBool(getEnv("TLS_REQUIRED", "false"))
+	if err != nil {
+		tlsRequired = false
+	}
+
+	listenAddr := getEnv("LISTEN_ADDR", ":1025")
+	listeners, err := parseListeners(getEnv("LISTENERS", ""), listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 套接字权限使用八进制表示，例如0660
+	unixSocketMode, err := strconv.ParseUint(getEnv("UNIX_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil || unixSocketMode > 0777 {
+		return nil, fmt.Errorf("无效的UNIX_SOCKET_MODE: %q", getEnv("UNIX_SOCKET_MODE", ""))
+	}
+
+	authRequired, err := strconv.ParseBool(getEnv("AUTH_REQUIRED", "false"))
+	if err != nil {
+		authRequired = false
+	}
+
+	allowInsecureAuth, err := strconv.ParseBool(getEnv("ALLOW_INSECURE_AUTH", "false"))
+	if err != nil {
+		allowInsecureAuth = false
+	}
+
+	maxAuthFailures, err := strconv.Atoi(getEnv("MAX_AUTH_FAILURES", "3"))
+	if err != nil || maxAuthFailures < 0 {
+		maxAuthFailures = 3
+	}
+
+	allowedNetworks, err := parsePrefixes(getEnv("ALLOWED_NETWORKS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("ALLOWED_NETWORKS: %w", err)
+	}
+
+	deniedNetworks, err := parsePrefixes(getEnv("DENIED_NETWORKS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("DENIED_NETWORKS: %w", err)
+	}
+
+	trustedNetworks, err := parsePrefixes(getEnv("TRUSTED_NETWORKS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_NETWORKS: %w", err)
+	}
+
+	trustedProxies, err := parsePrefixes(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+
+	maxRecipients, err := strconv.Atoi(getEnv("MAX_RECIPIENTS", "0"))
+	if err != nil || maxRecipients < 0 {
+		maxRecipients = 0
+	}
+
+	greetingTimeout := getDuration("GREETING_TIMEOUT", 300)
+	mailTimeout := getDuration("MAIL_TIMEOUT", 300)
+	rcptTimeout := getDuration("RCPT_TIMEOUT", 300)
+	dataBlockTimeout := getDuration("DATA_BLOCK_TIMEOUT", 180)
+	dataTerminationTimeout := getDuration("DATA_TERMINATION_TIMEOUT", 600)
+
+	maxConnections, err := strconv.Atoi(getEnv("MAX_CONNECTIONS", "0"))
+	if err != nil || maxConnections < 0 {
+		maxConnections = 0
+	}
+
+	maxConnectionsPerIP, err := strconv.Atoi(getEnv("MAX_CONNECTIONS_PER_IP", "0"))
+	if err != nil || maxConnectionsPerIP < 0 {
+		maxConnectionsPerIP = 0
+	}
+
+	messageRateLimit, err := strconv.Atoi(getEnv("MESSAGE_RATE_LIMIT", "0"))
+	if err != nil || messageRateLimit < 0 {
+		messageRateLimit = 0
+	}
+
+	recipientRateLimit, err := strconv.Atoi(getEnv("RECIPIENT_RATE_LIMIT", "0"))
+	if err != nil || recipientRateLimit < 0 {
+		recipientRateLimit = 0
+	}
+
+	workerID := getEnv("WORKER_ID", "")
+	if workerID == "" {
+		workerID = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	}
+
+	leaseDuration := getDuration("LEASE_DURATION", 600)
+	deliveryTimeout := getDuration("DELIVERY_TIMEOUT", 300)
+	if deliveryTimeout >= leaseDuration {
+		return nil, fmt.Errorf("DELIVERY_TIMEOUT（%s）必须小于LEASE_DURATION（%s）", deliveryTimeout, leaseDuration)
+	}
+
+	maxMessageSize, err := strconv.ParseInt(getEnv("MAX_MESSAGE_SIZE", "26214400"), 10, 64)
+	if err != nil || maxMessageSize < 0 {
+		maxMessageSize = 26214400
+	}
+
 	return &Config{
-		ListenAddr:     getEnv("LISTEN_ADDR", ":1025"),
-		DBPath:         getEnv("DB_PATH", "./smtp_queue.db"),
-		QueueInterval:  time.Duration(queueInterval) * time.Second,
-		MaxEmailAge:    time.Duration(maxEmailAge) * time.Hour,
-		MaxFailCount:   maxFailCount,
-		SMTPHost:       getEnv("SMTP_HOST", ""),
-		SMTPPort:       smtpPort,
-		SMTPUsername:   getEnv("SMTP_USERNAME", ""),
-		SMTPPassword:   getEnv("SMTP_PASSWORD", ""),
-		SMTPFrom:       getEnv("SMTP_FROM", ""),
-		SMTPEncryption: smtpEncryption,
+		ListenAddr:             listenAddr,
+		Listeners:              listeners,
+		UnixSocketMode:         os.FileMode(unixSocketMode),
+		UnixSocketOwner:        getEnv("UNIX_SOCKET_OWNER", ""),
+		Hostname:               hostname,
+		TLSCertFile:            getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:             getEnv("TLS_KEY_FILE", ""),
+		TLSRequired:            tlsRequired,
+		AuthUsersFile:          getEnv("AUTH_USERS_FILE", ""),
+		AuthRequired:           authRequired,
+		AllowInsecureAuth:      allowInsecureAuth,
+		MaxAuthFailures:        maxAuthFailures,
+		AllowedNetworks:        allowedNetworks,
+		DeniedNetworks:         deniedNetworks,
+		TrustedNetworks:        trustedNetworks,
+		TrustedProxies:         trustedProxies,
+		PolicyFile:             getEnv("POLICY_FILE", ""),
+		MaxRecipients:          maxRecipients,
+		GreetingTimeout:        greetingTimeout,
+		MailTimeout:            mailTimeout,
+		RcptTimeout:            rcptTimeout,
+		DataBlockTimeout:       dataBlockTimeout,
+		DataTerminationTimeout: dataTerminationTimeout,
+		MaxConnections:         maxConnections,
+		MaxConnectionsPerIP:    maxConnectionsPerIP,
+		MessageRateLimit:       messageRateLimit,
+		RecipientRateLimit:     recipientRateLimit,
+		MaxMessageSize:         maxMessageSize,
+		QueueStore:             strings.ToLower(getEnv("QUEUE_STORE", "sqlite")),
+		DBPath:                 getEnv("DB_PATH", "./smtp_queue.db"),
+		SpoolDir:               getEnv("SPOOL_DIR", "./spool"),
+		PostgresDSN:            getEnv("POSTGRES_DSN", ""),
+		QueueInterval:          time.Duration(queueInterval) * time.Second,
+		WorkerID:               workerID,
+		LeaseDuration:          leaseDuration,
+		DeliveryTimeout:        deliveryTimeout,
+		MaxEmailAge:            time.Duration(maxEmailAge) * time.Hour,
+		MaxFailCount:           maxFailCount,
+		DelayWarningTime:       time.Duration(delayWarningTime) * time.Hour,
+		SMTPHost:               getEnv("SMTP_HOST", ""),
+		SMTPPort:               smtpPort,
+		SMTPUsername:           getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:           getEnv("SMTP_PASSWORD", ""),
+		SMTPFrom:               getEnv("SMTP_FROM", ""),
+		SMTPEncryption:         smtpEncryption,
 	}, nil
 }
 
+// parseListeners 解析监听器列表，格式为逗号分隔的 "模式[+proxy]@地址"，
+// 例如 "starttls@:1025,tls+proxy@:1465,lmtp@unix:/run/smtp-queue/lmtp.sock"。
+// 模式后附加 +proxy 表示该监听器上的连接以PROXY协议头开始。
+// 列表为空时使用默认地址的STARTTLS监听器
+func parseListeners(spec, defaultAddr string) ([]ListenerConfig, error) {
+	if strings.TrimSpace(spec) == "" {
+		return []ListenerConfig{{Addr: defaultAddr, Mode: ListenerModeStartTLS}}, nil
+	}
+
+	var listeners []ListenerConfig
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		mode, addr, ok := strings.Cut(item, "@")
+		if !ok || addr == "" {
+			return nil, fmt.Errorf("无效的监听器配置: %q", item)
+		}
+
+		mode = strings.ToLower(mode)
+		mode, proxy := strings.CutSuffix(mode, "+proxy")
+		switch mode {
+		case ListenerModePlain, ListenerModeStartTLS, ListenerModeTLS, ListenerModeLMTP:
+		default:
+			return nil, fmt.Errorf("未知的监听器模式: %q", mode)
+		}
+
+		listeners = append(listeners, ListenerConfig{Addr: addr, Mode: mode, ProxyProtocol: proxy})
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("LISTENERS 中没有有效的监听器")
+	}
+	return listeners, nil
+}
+
+// parsePrefixes 解析逗号分隔的CIDR列表，单个IP地址视为仅包含该地址的网段
+func parsePrefixes(spec string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("无效的IP地址: %q", item)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的网段: %q", item)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// getDuration 获取以秒为单位的时长，无效或不为正数时返回默认值
+func getDuration(key string, defaultSeconds int) time.Duration {
+	seconds, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 // getEnv 获取环境变量，如果不存在则返回默认值
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
@@ -1,7 +1,12 @@
 package db
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -9,7 +14,8 @@ import (
 
 // Email 代表队列中的一封电子邮件
 type Email struct {
-	ID        int64
+	ID        int64  // 存储内部的行标识，spool存储中为0，日志和通知中使用QueueID
+	QueueID   string // 队列标识，在SMTP响应、Received头和日志中用于追踪邮件
 	From      string
 	To        []string
 	Subject   string
@@ -19,173 +25,384 @@ type Email struct {
 	SentAt    *time.Time
 	FailCount int
 	LastError string
+	BodyType  string // MAIL FROM 的BODY参数：7BIT、8BITMIME或BINARYMIME，未指定时为空
+	AuthUser  string // 投递该邮件的客户端认证身份，未认证时为空
+
+	// 是否已向发件人发送过延迟通知
+	DelayNotified bool
+
+	// 客户端提交的ESMTP参数，格式同SMTP命令，例如 "SIZE=1000 BODY=8BITMIME"
+	MailParams string
+	RcptParams []string // 与To一一对应
+
+	// 租约：邮件被取出投递时记录持有者和到期时间，等待投递时为空
+	LeaseOwner string
+	LeaseUntil *time.Time
 }
 
-// DB 是数据库操作的包装器
+// DB 是基于SQLite的队列存储
 type DB struct {
 	db *sql.DB
 }
 
-// Init 初始化数据库连接并确保表已创建
+var _ Store = (*DB)(nil)
+
+// Init 打开数据库并执行尚未执行的结构迁移
 func Init(dbPath string) (*DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	d, err := Open(dbPath)
 	if err != nil {
 		return nil, err
 	}
 
-	// 创建邮件队列表
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS emails (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		from_address TEXT NOT NULL,
-		to_addresses TEXT NOT NULL,
-		subject TEXT NOT NULL,
-		body TEXT NOT NULL,
-		created_at TIMESTAMP NOT NULL,
-		sent BOOLEAN NOT NULL DEFAULT 0,
-		sent_at TIMESTAMP,
-		fail_count INTEGER NOT NULL DEFAULT 0,
-		last_error TEXT
-	)`)
-	if err != nil {
+	if _, err := d.Migrate(); err != nil {
+		d.Close()
 		return nil, err
 	}
+	return d, nil
+}
 
+// Open 打开数据库连接，不执行结构迁移
+func Open(dbPath string) (*DB, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
 	return &DB{db: db}, nil
 }
 
+// NewQueueID 生成新的队列标识
+func NewQueueID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%X", time.Now().UnixNano())
+	}
+	return strings.ToUpper(hex.EncodeToString(buf))
+}
+
 // Close 关闭数据库连接
 func (d *DB) Close() error {
 	return d.db.Close()
 }
 
-// QueueEmail 将邮件添加到队列中
-func (d *DB) QueueEmail(from string, to []string, subject, body string) (int64, error) {
-	// 将收件人列表序列化为字符串
-	toStr := ""
-	for i, addr := range to {
-		if i > 0 {
-			toStr += ";"
-		}
-		toStr += addr
+// Enqueue 将邮件添加到队列中
+func (d *DB) Enqueue(email *Email) error {
+	if email.QueueID == "" {
+		email.QueueID = NewQueueID()
+	}
+	email.Created = time.Now()
+
+	toStr, rcptParamsJSON, err := encodeRecipients(email)
+	if err != nil {
+		return err
 	}
 
 	result, err := d.db.Exec(
-		"INSERT INTO emails (from_address, to_addresses, subject, body, created_at) VALUES (?, ?, ?, ?, ?)",
-		from, toStr, subject, body, time.Now(),
+		"INSERT INTO emails (queue_id, from_address, to_addresses, subject, body, created_at, auth_user, body_type, mail_params, rcpt_params) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		email.QueueID, email.From, toStr, email.Subject, email.Body, email.Created, email.AuthUser, email.BodyType, email.MailParams, rcptParamsJSON,
 	)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return result.LastInsertId()
+	email.ID, err = result.LastInsertId()
+	return err
+}
+
+// 将收件人列表和收件人参数序列化为JSON数组，带引号的本地部分和收件人参数中都可能包含分号
+func encodeRecipients(email *Email) (to, rcptParams string, err error) {
+	to, err = encodeStrings(email.To)
+	if err != nil {
+		return "", "", err
+	}
+	rcptParams, err = encodeStrings(email.RcptParams)
+	if err != nil {
+		return "", "", err
+	}
+	return to, rcptParams, nil
+}
+
+// 将字符串列表序列化为JSON数组，nil序列化为空数组
+func encodeStrings(values []string) (string, error) {
+	if values == nil {
+		values = []string{}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
 }
 
-// GetPendingEmails 获取等待发送的邮件
-func (d *DB) GetPendingEmails(limit int) ([]*Email, error) {
+// 查询邮件时选择的列，顺序与scanEmails一致
+const emailColumns = "id, queue_id, from_address, to_addresses, subject, body, created_at, sent, fail_count, last_error, auth_user, body_type, mail_params, rcpt_params, delay_notified, lease_owner, lease_until"
+
+// Claim 在一条UPDATE语句中选出等待发送的邮件并记录租约，避免同一封邮件被重复取出
+func (d *DB) Claim(owner string, limit int, lease time.Duration) ([]*Email, error) {
 	rows, err := d.db.Query(`
-		SELECT id, from_address, to_addresses, subject, body, created_at, fail_count, last_error
-		FROM emails
-		WHERE sent = 0
-		ORDER BY created_at ASC
-		LIMIT ?
-	`, limit)
+		UPDATE emails SET lease_owner = ?, lease_until = ?
+		WHERE id IN (
+			SELECT id FROM emails
+			WHERE sent = 0 AND lease_owner = ''
+			ORDER BY created_at ASC
+			LIMIT ?
+		)
+		RETURNING `+emailColumns,
+		owner, time.Now().Add(lease), limit,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	emails, err := scanEmails(rows)
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING不保证顺序
+	sortByCreated(emails)
+	return emails, nil
+}
+
+// Reap 将租约已到期的邮件放回队列
+func (d *DB) Reap() (int, error) {
+	result, err := d.db.Exec(
+		"UPDATE emails SET lease_owner = '', lease_until = NULL WHERE lease_owner <> '' AND lease_until < ?",
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := result.RowsAffected()
+	return int(count), err
+}
+
+// 读取查询结果中的全部邮件
+func scanEmails(rows *sql.Rows) ([]*Email, error) {
 	var emails []*Email
 	for rows.Next() {
 		var (
-			id        int64
-			from      string
-			toStr     string
-			subject   string
-			body      string
-			createdAt time.Time
-			failCount int
-			lastError sql.NullString
+			id             int64
+			queueID        string
+			from           string
+			toStr          string
+			subject        string
+			body           string
+			createdAt      time.Time
+			sent           bool
+			failCount      int
+			lastError      sql.NullString
+			authUser       string
+			bodyType       string
+			mailParams     string
+			rcptParamsJSON string
+			delayNotified  bool
+			leaseOwner     string
+			leaseUntil     sql.NullTime
 		)
 
-		if err := rows.Scan(&id, &from, &toStr, &subject, &body, &createdAt, &failCount, &lastError); err != nil {
+		if err := rows.Scan(&id, &queueID, &from, &toStr, &subject, &body, &createdAt, &sent, &failCount, &lastError, &authUser, &bodyType, &mailParams, &rcptParamsJSON, &delayNotified, &leaseOwner, &leaseUntil); err != nil {
 			return nil, err
 		}
 
+		var rcptParams []string
+		if err := json.Unmarshal([]byte(rcptParamsJSON), &rcptParams); err != nil {
+			return nil, fmt.Errorf("解析邮件 %d 的收件人参数时出错: %w", id, err)
+		}
+
 		// 解析收件人列表
-		to := splitAddresses(toStr)
+		to, err := decodeAddresses(toStr)
+		if err != nil {
+			return nil, fmt.Errorf("解析邮件 %d 的收件人列表时出错: %w", id, err)
+		}
 
 		lastErrorStr := ""
 		if lastError.Valid {
 			lastErrorStr = lastError.String
 		}
 
-		emails = append(emails, &Email{
-			ID:        id,
-			From:      from,
-			To:        to,
-			Subject:   subject,
-			Body:      body,
-			Created:   createdAt,
-			Sent:      false,
-			FailCount: failCount,
-			LastError: lastErrorStr,
-		})
+		email := &Email{
+			ID:            id,
+			QueueID:       queueID,
+			From:          from,
+			To:            to,
+			Subject:       subject,
+			Body:          body,
+			Created:       createdAt,
+			Sent:          sent,
+			FailCount:     failCount,
+			LastError:     lastErrorStr,
+			BodyType:      bodyType,
+			AuthUser:      authUser,
+			MailParams:    mailParams,
+			RcptParams:    rcptParams,
+			DelayNotified: delayNotified,
+			LeaseOwner:    leaseOwner,
+		}
+		if leaseUntil.Valid {
+			email.LeaseUntil = &leaseUntil.Time
+		}
+		emails = append(emails, email)
 	}
 
 	return emails, rows.Err()
 }
 
-// MarkEmailSent 将邮件标记为已发送
-func (d *DB) MarkEmailSent(id int64) error {
-	_, err := d.db.Exec(
-		"UPDATE emails SET sent = 1, sent_at = ? WHERE id = ?",
-		time.Now(), id,
-	)
-	return err
+// List 列出队列中的全部邮件
+func (d *DB) List() ([]*Email, error) {
+	rows, err := d.db.Query(`
+		SELECT ` + emailColumns + `
+		FROM emails
+		ORDER BY created_at ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanEmails(rows)
 }
 
-// DeleteEmail 从数据库中删除邮件
-func (d *DB) DeleteEmail(id int64) error {
-	_, err := d.db.Exec("DELETE FROM emails WHERE id = ?", id)
-	return err
+// Ack 确认邮件已发送并将其从数据库中删除
+func (d *DB) Ack(email *Email) error {
+	return d.Delete(email)
 }
 
-// MarkEmailFailed 标记邮件发送失败并增加失败计数
-func (d *DB) MarkEmailFailed(id int64, errorMsg string) error {
-	_, err := d.db.Exec(
-		"UPDATE emails SET fail_count = fail_count + 1, last_error = ? WHERE id = ?",
-		errorMsg, id,
-	)
-	return err
+// Delete 从数据库中删除邮件
+func (d *DB) Delete(email *Email) error {
+	return leaseResult(d.db.Exec("DELETE FROM emails WHERE id = ? AND lease_owner = ?", email.ID, email.LeaseOwner))
 }
 
-// CleanupOldEmails 清理过老的邮件
-func (d *DB) CleanupOldEmails(maxAge time.Duration, maxFailCount int) (int64, error) {
-	// 删除超过最大失败次数的邮件
-	failResult, err := d.db.Exec(
-		"DELETE FROM emails WHERE fail_count >= ?",
-		maxFailCount,
-	)
+// Renew 延长邮件的租约
+func (d *DB) Renew(email *Email, lease time.Duration) error {
+	leaseUntil := time.Now().Add(lease)
+	err := leaseResult(d.db.Exec(
+		"UPDATE emails SET lease_until = ? WHERE id = ? AND lease_owner = ?",
+		leaseUntil, email.ID, email.LeaseOwner,
+	))
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	email.LeaseUntil = &leaseUntil
+	return nil
+}
+
+// Fail 标记邮件发送失败并增加失败计数，同时释放租约以便下次重试
+func (d *DB) Fail(email *Email, reason string) error {
+	err := leaseResult(d.db.Exec(
+		"UPDATE emails SET fail_count = fail_count + 1, last_error = ?, lease_owner = '', lease_until = NULL WHERE id = ? AND lease_owner = ?",
+		reason, email.ID, email.LeaseOwner,
+	))
+	if err != nil {
+		return err
+	}
+
+	email.FailCount++
+	email.LastError = reason
+	email.LeaseOwner = ""
+	email.LeaseUntil = nil
+	return nil
+}
+
+// SetRecipients 替换邮件的收件人及其参数
+func (d *DB) SetRecipients(email *Email, to, rcptParams []string) error {
+	toStr, rcptParamsJSON, err := encodeRecipients(&Email{To: to, RcptParams: rcptParams})
+	if err != nil {
+		return err
 	}
 
-	// 删除过老的邮件
+	err = leaseResult(d.db.Exec(
+		"UPDATE emails SET to_addresses = ?, rcpt_params = ? WHERE id = ? AND lease_owner = ?",
+		toStr, rcptParamsJSON, email.ID, email.LeaseOwner,
+	))
+	if err != nil {
+		return err
+	}
+
+	email.To = to
+	email.RcptParams = rcptParams
+	return nil
+}
+
+// MarkDelayNotified 记录已向发件人发送延迟通知
+func (d *DB) MarkDelayNotified(email *Email) error {
+	err := leaseResult(d.db.Exec(
+		"UPDATE emails SET delay_notified = 1 WHERE id = ? AND lease_owner = ?",
+		email.ID, email.LeaseOwner,
+	))
+	if err != nil {
+		return err
+	}
+
+	email.DelayNotified = true
+	return nil
+}
+
+// 检查按租约持有者更新邮件的结果，没有更新任何行时说明租约已失效
+func leaseResult(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Cleanup 清理过老或失败次数过多的邮件，返回被删除的邮件以便通知发件人
+//
+// 正在投递（持有租约）的邮件不会被清理。
+func (d *DB) Cleanup(maxAge time.Duration, maxFailCount int) ([]*Email, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	oldTime := time.Now().Add(-maxAge)
-	ageResult, err := d.db.Exec(
-		"DELETE FROM emails WHERE created_at < ?",
-		oldTime,
-	)
+	rows, err := tx.Query(`
+		SELECT `+emailColumns+`
+		FROM emails
+		WHERE (fail_count >= ? OR created_at < ?) AND lease_owner = ''
+	`, maxFailCount, oldTime)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	emails, err := scanEmails(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, email := range emails {
+		if _, err := tx.Exec("DELETE FROM emails WHERE id = ?", email.ID); err != nil {
+			return nil, err
+		}
 	}
 
-	// 计算总共删除的邮件数
-	failCount, _ := failResult.RowsAffected()
-	ageCount, _ := ageResult.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
 
-	return failCount + ageCount, nil
+// 解析收件人列表，兼容以分号分隔的旧格式
+func decodeAddresses(addresses string) ([]string, error) {
+	if !strings.HasPrefix(addresses, "[") {
+		return splitAddresses(addresses), nil
+	}
+
+	var to []string
+	if err := json.Unmarshal([]byte(addresses), &to); err != nil {
+		return nil, err
+	}
+	return to, nil
 }
 
 // 辅助函数：拆分地址字符串
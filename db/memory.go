@@ -0,0 +1,208 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore 是保存在内存中的队列存储，进程退出后队列丢失，用于测试和临时环境
+type MemoryStore struct {
+	mu     sync.Mutex
+	nextID int64
+	emails map[int64]*Email
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore 创建空的内存队列
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{emails: make(map[int64]*Email)}
+}
+
+// Enqueue 将邮件加入队列
+func (m *MemoryStore) Enqueue(email *Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if email.QueueID == "" {
+		email.QueueID = NewQueueID()
+	}
+	m.nextID++
+	email.ID = m.nextID
+	email.Created = time.Now()
+
+	m.emails[email.ID] = cloneEmail(email)
+	return nil
+}
+
+// Claim 取出等待发送的邮件并记录租约
+func (m *MemoryStore) Claim(owner string, limit int, lease time.Duration) ([]*Email, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pending []*Email
+	for _, email := range m.emails {
+		if !email.Sent && email.LeaseOwner == "" {
+			pending = append(pending, email)
+		}
+	}
+	sortByCreated(pending)
+	if len(pending) > limit {
+		pending = pending[:limit]
+	}
+
+	leaseUntil := time.Now().Add(lease)
+	result := make([]*Email, len(pending))
+	for i, email := range pending {
+		email.LeaseOwner = owner
+		email.LeaseUntil = &leaseUntil
+		result[i] = cloneEmail(email)
+	}
+	return result, nil
+}
+
+// Reap 将租约已到期的邮件放回队列
+func (m *MemoryStore) Reap() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, email := range m.emails {
+		if leaseExpired(email, now) {
+			email.LeaseOwner = ""
+			email.LeaseUntil = nil
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Ack 确认邮件已发送并将其从队列中删除
+func (m *MemoryStore) Ack(email *Email) error {
+	return m.Delete(email)
+}
+
+// Renew 延长邮件的租约
+func (m *MemoryStore) Renew(email *Email, lease time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, err := m.leased(email)
+	if err != nil {
+		return err
+	}
+
+	leaseUntil := time.Now().Add(lease)
+	stored.LeaseUntil = &leaseUntil
+	email.LeaseUntil = &leaseUntil
+	return nil
+}
+
+// Fail 标记邮件发送失败并增加失败计数，同时释放租约
+func (m *MemoryStore) Fail(email *Email, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, err := m.leased(email)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range []*Email{stored, email} {
+		e.FailCount++
+		e.LastError = reason
+		e.LeaseOwner = ""
+		e.LeaseUntil = nil
+	}
+	return nil
+}
+
+// SetRecipients 替换邮件的收件人及其参数
+func (m *MemoryStore) SetRecipients(email *Email, to, rcptParams []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, err := m.leased(email)
+	if err != nil {
+		return err
+	}
+
+	// 存储中保留副本，调用方之后修改切片不影响队列
+	stored.To = append([]string(nil), to...)
+	stored.RcptParams = append([]string(nil), rcptParams...)
+	email.To = to
+	email.RcptParams = rcptParams
+	return nil
+}
+
+// MarkDelayNotified 记录已向发件人发送延迟通知
+func (m *MemoryStore) MarkDelayNotified(email *Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, err := m.leased(email)
+	if err != nil {
+		return err
+	}
+
+	stored.DelayNotified = true
+	email.DelayNotified = true
+	return nil
+}
+
+// Delete 从队列中删除邮件
+func (m *MemoryStore) Delete(email *Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.leased(email); err != nil {
+		return err
+	}
+	delete(m.emails, email.ID)
+	return nil
+}
+
+// 返回租约仍由调用方持有的已存储邮件
+func (m *MemoryStore) leased(email *Email) (*Email, error) {
+	stored, ok := m.emails[email.ID]
+	if !ok || stored.LeaseOwner != email.LeaseOwner {
+		return nil, ErrLeaseLost
+	}
+	return stored, nil
+}
+
+// List 列出队列中的全部邮件
+func (m *MemoryStore) List() ([]*Email, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]*Email, 0, len(m.emails))
+	for _, email := range m.emails {
+		result = append(result, cloneEmail(email))
+	}
+	sortByCreated(result)
+	return result, nil
+}
+
+// Cleanup 清理过老或失败次数过多的邮件，正在投递的邮件不会被清理
+func (m *MemoryStore) Cleanup(maxAge time.Duration, maxFailCount int) ([]*Email, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldTime := time.Now().Add(-maxAge)
+	var removed []*Email
+	for id, email := range m.emails {
+		if expired(email, oldTime, maxFailCount) {
+			removed = append(removed, email)
+			delete(m.emails, id)
+		}
+	}
+	sortByCreated(removed)
+	return removed, nil
+}
+
+// Close 内存队列无需释放资源
+func (m *MemoryStore) Close() error {
+	return nil
+}
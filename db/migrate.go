@@ -0,0 +1,270 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 数据库结构迁移脚本，文件名格式为 "版本号_名称.sql"，按版本号顺序执行。
+// migrations目录下是SQLite的迁移，migrations/postgres目录下是PostgreSQL的迁移
+//
+//go:embed migrations/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// 迁移脚本所在的目录
+const (
+	sqliteMigrations   = "migrations"
+	postgresMigrations = "migrations/postgres"
+)
+
+// Migration 是一个结构迁移步骤
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus 描述一个迁移步骤的执行状态
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// 加载目录中全部内置的迁移脚本
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, title, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("无效的迁移文件名: %s", entry.Name())
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: title, SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("迁移版本 %d 重复", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// 创建版本记录表；对于没有版本记录的旧数据库，将其记录为初始版本
+func ensureSchemaVersion(db *sql.DB) error {
+	exists, err := hasTable(db, "schema_version")
+	if err != nil || exists {
+		return err
+	}
+
+	baseline, err := legacyVersion(db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+	CREATE TABLE schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	if baseline > 0 {
+		migrations, err := loadMigrations(sqliteMigrations)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if m.Version > baseline {
+				break
+			}
+			if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 判断表是否存在
+func hasTable(db *sql.DB, table string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+// 推断没有版本记录的数据库的结构版本：引入版本记录之前的emails表即为版本1，表不存在时返回0
+func legacyVersion(db *sql.DB) (int, error) {
+	exists, err := hasTable(db, "emails")
+	if err != nil || !exists {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// 读取已执行的迁移版本
+func appliedVersions(db *sql.DB) (map[int]time.Time, error) {
+	rows, err := db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Migrate 按顺序执行尚未执行的迁移，每个迁移在独立的事务中执行并记录版本，
+// 返回本次执行的迁移数量
+func (d *DB) Migrate() (int, error) {
+	if err := ensureSchemaVersion(d.db); err != nil {
+		return 0, fmt.Errorf("初始化版本记录时出错: %w", err)
+	}
+
+	migrations, err := loadMigrations(sqliteMigrations)
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := appliedVersions(d.db)
+	if err != nil {
+		return 0, err
+	}
+
+	pending, err := pendingMigrations(migrations, applied)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range pending {
+		if err := d.applyMigration(m); err != nil {
+			return count, fmt.Errorf("执行迁移 %04d_%s 时出错: %w", m.Version, m.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// 返回尚未执行的迁移；数据库由更新的版本迁移过时返回错误，避免旧程序写入不兼容的数据
+func pendingMigrations(migrations []Migration, applied map[int]time.Time) ([]Migration, error) {
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	for version := range applied {
+		if version > latest {
+			return nil, fmt.Errorf("数据库结构版本 %d 高于程序支持的版本 %d", version, latest)
+		}
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// 在事务中执行单个迁移并记录版本
+func (d *DB) applyMigration(m Migration) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrationStatus 返回全部迁移的执行状态，不执行任何迁移
+func (d *DB) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(sqliteMigrations)
+	if err != nil {
+		return nil, err
+	}
+
+	// 尚未创建版本记录表时，按旧数据库的结构推断
+	applied := make(map[int]time.Time)
+	exists, err := hasTable(d.db, "schema_version")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if applied, err = appliedVersions(d.db); err != nil {
+			return nil, err
+		}
+	} else {
+		baseline, err := legacyVersion(d.db)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range migrations {
+			if m.Version <= baseline {
+				applied[m.Version] = time.Time{}
+			}
+		}
+	}
+
+	return migrationStatus(migrations, applied), nil
+}
+
+// 根据已执行的版本生成每个迁移的状态
+func migrationStatus(migrations []Migration, applied map[int]time.Time) []MigrationStatus {
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		status = append(status, MigrationStatus{Migration: m, Applied: ok, AppliedAt: appliedAt})
+	}
+	return status
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// 引入版本记录之前的emails表结构
+const baselineSchema = `CREATE TABLE emails (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	from_address TEXT NOT NULL,
+	to_addresses TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	body TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	sent BOOLEAN NOT NULL DEFAULT 0,
+	sent_at TIMESTAMP,
+	fail_count INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT
+)`
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	d, err := Open(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// 统计已执行的迁移数量
+func appliedCount(t *testing.T, d *DB) (applied, total int) {
+	t.Helper()
+
+	status, err := d.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.Applied {
+			applied++
+		}
+	}
+	return applied, len(status)
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	d := openTestDB(t)
+
+	applied, total := appliedCount(t, d)
+	if applied != 0 || total == 0 {
+		t.Fatalf("新数据库的迁移状态 = %d/%d", applied, total)
+	}
+
+	count, err := d.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != total {
+		t.Errorf("Migrate() = %d，期望 %d", count, total)
+	}
+
+	// 重复执行不做任何事
+	if count, err := d.Migrate(); err != nil || count != 0 {
+		t.Errorf("再次 Migrate() = %d, %v", count, err)
+	}
+	if applied, _ := appliedCount(t, d); applied != total {
+		t.Errorf("已执行 %d 个迁移，期望 %d", applied, total)
+	}
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	d := openTestDB(t)
+
+	if _, err := d.db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Exec("INSERT INTO emails (from_address, to_addresses, subject, body, created_at) VALUES ('a@example.com', 'b@example.com', 's', 'body', CURRENT_TIMESTAMP)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有版本记录的旧数据库视为已执行初始迁移
+	applied, total := appliedCount(t, d)
+	if applied != 1 {
+		t.Fatalf("旧数据库的迁移状态 = %d/%d，期望 1/%d", applied, total, total)
+	}
+
+	count, err := d.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != total-1 {
+		t.Errorf("Migrate() = %d，期望 %d", count, total-1)
+	}
+
+	var rows int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM emails").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("迁移后有 %d 封邮件，期望 1 封", rows)
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	d := openTestDB(t)
+
+	if _, err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (9999, 'future', CURRENT_TIMESTAMP)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Migrate(); err == nil {
+		t.Error("数据库版本高于程序支持的版本时应当返回错误")
+	}
+}
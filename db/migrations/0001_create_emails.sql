@@ -0,0 +1,13 @@
+-- 邮件队列表的初始结构
+CREATE TABLE IF NOT EXISTS emails (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	from_address TEXT NOT NULL,
+	to_addresses TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	body TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	sent BOOLEAN NOT NULL DEFAULT 0,
+	sent_at TIMESTAMP,
+	fail_count INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT
+);
@@ -0,0 +1,2 @@
+-- 投递邮件的客户端认证身份
+ALTER TABLE emails ADD COLUMN auth_user TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- MAIL FROM 的BODY参数
+ALTER TABLE emails ADD COLUMN body_type TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- 客户端提交的MAIL FROM和RCPT TO参数，收件人参数以JSON数组保存
+ALTER TABLE emails ADD COLUMN mail_params TEXT NOT NULL DEFAULT '';
+ALTER TABLE emails ADD COLUMN rcpt_params TEXT NOT NULL DEFAULT '[]';
@@ -0,0 +1,2 @@
+-- 是否已向发件人发送过延迟通知
+ALTER TABLE emails ADD COLUMN delay_notified BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- 队列标识，旧邮件使用自增ID补齐
+ALTER TABLE emails ADD COLUMN queue_id TEXT NOT NULL DEFAULT '';
+UPDATE emails SET queue_id = printf('%016X', id) WHERE queue_id = '';
@@ -0,0 +1,3 @@
+-- 取出邮件的租约，lease_owner为空表示邮件等待投递
+ALTER TABLE emails ADD COLUMN lease_owner TEXT NOT NULL DEFAULT '';
+ALTER TABLE emails ADD COLUMN lease_until TIMESTAMP;
@@ -0,0 +1,23 @@
+-- 邮件队列表的初始结构，lease_owner为空表示邮件等待投递，否则邮件由该工作者持有直到lease_until
+CREATE TABLE IF NOT EXISTS emails (
+	id BIGSERIAL PRIMARY KEY,
+	queue_id TEXT NOT NULL UNIQUE,
+	from_address TEXT NOT NULL,
+	to_addresses TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	body TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	sent BOOLEAN NOT NULL DEFAULT FALSE,
+	sent_at TIMESTAMPTZ,
+	fail_count INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	auth_user TEXT NOT NULL DEFAULT '',
+	body_type TEXT NOT NULL DEFAULT '',
+	mail_params TEXT NOT NULL DEFAULT '',
+	rcpt_params TEXT NOT NULL DEFAULT '[]',
+	delay_notified BOOLEAN NOT NULL DEFAULT FALSE,
+	lease_owner TEXT NOT NULL DEFAULT '',
+	lease_until TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS emails_pending_idx ON emails (created_at) WHERE NOT sent;
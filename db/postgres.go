@@ -0,0 +1,328 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// 执行结构迁移时使用的咨询锁，避免多个实例同时迁移
+const postgresMigrationLock = 0x534d5450
+
+// PostgresStore 是基于PostgreSQL的队列存储，多个实例可以共享同一个队列
+//
+// Claim使用 SELECT ... FOR UPDATE SKIP LOCKED 取出邮件并记录租约，
+// 其他实例会跳过已被取出的邮件，因此同一封邮件不会被多个实例同时投递。
+// 租约的到期时间使用数据库服务器的时钟，不受各实例时钟偏差的影响。
+type PostgresStore struct {
+	db *sql.DB
+}
+
+var _ Store = (*PostgresStore)(nil)
+
+// OpenPostgres 连接数据库并执行尚未执行的结构迁移
+func OpenPostgres(dsn string) (*PostgresStore, error) {
+	p, err := ConnectPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.Migrate(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// ConnectPostgres 连接数据库，不执行结构迁移
+func ConnectPostgres(dsn string) (*PostgresStore, error) {
+	if dsn == "" {
+		return nil, errors.New("未配置PostgreSQL连接字符串")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("连接PostgreSQL时出错: %w", err)
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+// Close 关闭数据库连接
+func (p *PostgresStore) Close() error {
+	return p.db.Close()
+}
+
+// Enqueue 将邮件添加到队列中
+func (p *PostgresStore) Enqueue(email *Email) error {
+	if email.QueueID == "" {
+		email.QueueID = NewQueueID()
+	}
+	email.Created = time.Now()
+
+	toStr, rcptParamsJSON, err := encodeRecipients(email)
+	if err != nil {
+		return err
+	}
+
+	return p.db.QueryRow(
+		"INSERT INTO emails (queue_id, from_address, to_addresses, subject, body, created_at, auth_user, body_type, mail_params, rcpt_params) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		email.QueueID, email.From, toStr, email.Subject, email.Body, email.Created, email.AuthUser, email.BodyType, email.MailParams, rcptParamsJSON,
+	).Scan(&email.ID)
+}
+
+// Claim 取出等待发送的邮件并记录租约，跳过其他实例正在取出的邮件
+func (p *PostgresStore) Claim(owner string, limit int, lease time.Duration) ([]*Email, error) {
+	rows, err := p.db.Query(`
+		UPDATE emails SET lease_owner = $1, lease_until = now() + $3::float8 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM emails
+			WHERE NOT sent AND lease_owner = ''
+			ORDER BY created_at ASC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+emailColumns,
+		owner, limit, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails, err := scanEmails(rows)
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING不保证顺序
+	sortByCreated(emails)
+	return emails, nil
+}
+
+// Reap 将租约已到期的邮件放回队列
+func (p *PostgresStore) Reap() (int, error) {
+	result, err := p.db.Exec("UPDATE emails SET lease_owner = '', lease_until = NULL WHERE lease_owner <> '' AND lease_until < now()")
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := result.RowsAffected()
+	return int(count), err
+}
+
+// List 列出队列中的全部邮件
+func (p *PostgresStore) List() ([]*Email, error) {
+	rows, err := p.db.Query(`
+		SELECT ` + emailColumns + `
+		FROM emails
+		ORDER BY created_at ASC, queue_id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanEmails(rows)
+}
+
+// Ack 确认邮件已发送并将其从数据库中删除
+func (p *PostgresStore) Ack(email *Email) error {
+	return p.Delete(email)
+}
+
+// Delete 从数据库中删除邮件
+func (p *PostgresStore) Delete(email *Email) error {
+	return leaseResult(p.db.Exec("DELETE FROM emails WHERE id = $1 AND lease_owner = $2", email.ID, email.LeaseOwner))
+}
+
+// Renew 延长邮件的租约
+func (p *PostgresStore) Renew(email *Email, lease time.Duration) error {
+	var leaseUntil time.Time
+	err := p.db.QueryRow(
+		"UPDATE emails SET lease_until = now() + $1::float8 * interval '1 second' WHERE id = $2 AND lease_owner = $3 RETURNING lease_until",
+		lease.Seconds(), email.ID, email.LeaseOwner,
+	).Scan(&leaseUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+
+	email.LeaseUntil = &leaseUntil
+	return nil
+}
+
+// Fail 标记邮件发送失败并增加失败计数，同时释放租约以便下次重试
+func (p *PostgresStore) Fail(email *Email, reason string) error {
+	err := leaseResult(p.db.Exec(
+		"UPDATE emails SET fail_count = fail_count + 1, last_error = $1, lease_owner = '', lease_until = NULL WHERE id = $2 AND lease_owner = $3",
+		reason, email.ID, email.LeaseOwner,
+	))
+	if err != nil {
+		return err
+	}
+
+	email.FailCount++
+	email.LastError = reason
+	email.LeaseOwner = ""
+	email.LeaseUntil = nil
+	return nil
+}
+
+// SetRecipients 替换邮件的收件人及其参数
+func (p *PostgresStore) SetRecipients(email *Email, to, rcptParams []string) error {
+	toStr, rcptParamsJSON, err := encodeRecipients(&Email{To: to, RcptParams: rcptParams})
+	if err != nil {
+		return err
+	}
+
+	err = leaseResult(p.db.Exec(
+		"UPDATE emails SET to_addresses = $1, rcpt_params = $2 WHERE id = $3 AND lease_owner = $4",
+		toStr, rcptParamsJSON, email.ID, email.LeaseOwner,
+	))
+	if err != nil {
+		return err
+	}
+
+	email.To = to
+	email.RcptParams = rcptParams
+	return nil
+}
+
+// MarkDelayNotified 记录已向发件人发送延迟通知
+func (p *PostgresStore) MarkDelayNotified(email *Email) error {
+	err := leaseResult(p.db.Exec(
+		"UPDATE emails SET delay_notified = TRUE WHERE id = $1 AND lease_owner = $2",
+		email.ID, email.LeaseOwner,
+	))
+	if err != nil {
+		return err
+	}
+
+	email.DelayNotified = true
+	return nil
+}
+
+// Cleanup 清理过老或失败次数过多的邮件，返回被删除的邮件以便通知发件人
+//
+// 其他实例正在投递的邮件不会被清理。
+func (p *PostgresStore) Cleanup(maxAge time.Duration, maxFailCount int) ([]*Email, error) {
+	oldTime := time.Now().Add(-maxAge)
+	rows, err := p.db.Query(`
+		DELETE FROM emails
+		WHERE id IN (
+			SELECT id FROM emails
+			WHERE (fail_count >= $1 OR created_at < $2) AND lease_owner = ''
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+emailColumns,
+		maxFailCount, oldTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails, err := scanEmails(rows)
+	if err != nil {
+		return nil, err
+	}
+	sortByCreated(emails)
+	return emails, nil
+}
+
+// Migrate 按顺序执行尚未执行的迁移，返回本次执行的迁移数量
+//
+// 迁移期间持有咨询锁，多个实例同时启动时依次执行，后获得锁的实例不会重复迁移。
+func (p *PostgresStore) Migrate() (int, error) {
+	ctx := context.Background()
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", postgresMigrationLock); err != nil {
+		return 0, fmt.Errorf("获取迁移锁时出错: %w", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", postgresMigrationLock)
+
+	if _, err := conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL
+	)`); err != nil {
+		return 0, fmt.Errorf("初始化版本记录时出错: %w", err)
+	}
+
+	migrations, err := loadMigrations(postgresMigrations)
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := appliedVersions(p.db)
+	if err != nil {
+		return 0, err
+	}
+
+	pending, err := pendingMigrations(migrations, applied)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range pending {
+		if err := applyPostgresMigration(ctx, conn, m); err != nil {
+			return count, fmt.Errorf("执行迁移 %04d_%s 时出错: %w", m.Version, m.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// 在事务中执行单个迁移并记录版本
+func applyPostgresMigration(ctx context.Context, conn *sql.Conn, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)", m.Version, m.Name, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrationStatus 返回全部迁移的执行状态，不执行任何迁移
+func (p *PostgresStore) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(postgresMigrations)
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := p.db.QueryRow("SELECT to_regclass('schema_version') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+	if exists {
+		if applied, err = appliedVersions(p.db); err != nil {
+			return nil, err
+		}
+	}
+	return migrationStatus(migrations, applied), nil
+}
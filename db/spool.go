@@ -0,0 +1,581 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spool目录中的状态子目录，邮件在状态之间通过重命名转移
+const (
+	spoolNew      = "new"      // 新入队，尚未尝试投递
+	spoolActive   = "active"   // 已被工作者取出，正在投递
+	spoolDeferred = "deferred" // 投递失败，等待重试
+	spoolFailed   = "failed"   // 文件损坏无法读取，隔离后等待人工处理
+)
+
+// 队列中的邮件所在的状态目录
+var spoolStates = []string{spoolNew, spoolActive, spoolDeferred}
+
+// SpoolStore 是基于文件系统目录的队列存储，目录结构类似Postfix的队列目录
+//
+// 每封邮件保存为两个文件：<队列标识>.eml 是RFC 5322格式的邮件内容，
+// <队列标识>.json 是信封信息（发件人、收件人、ESMTP参数、失败次数等）。
+// 邮件按状态保存在new、active、deferred子目录中，状态转移通过重命名完成；
+// 文件先写入tmp目录再重命名，进程崩溃不会留下不完整的邮件。
+// 信封文件是邮件存在的标志：入队时最后写入，删除时最先删除。
+//
+// 一个spool目录只能由一个进程使用。
+type SpoolStore struct {
+	mu        sync.Mutex
+	dir       string
+	recovered bool // 是否已在首次Claim时恢复过spool目录
+}
+
+var _ Store = (*SpoolStore)(nil)
+
+// 信封文件的内容
+type spoolEnvelope struct {
+	QueueID       string     `json:"queue_id"`
+	From          string     `json:"from"`
+	To            []string   `json:"to"`
+	Subject       string     `json:"subject"`
+	Created       time.Time  `json:"created"`
+	FailCount     int        `json:"fail_count"`
+	LastError     string     `json:"last_error,omitempty"`
+	BodyType      string     `json:"body_type,omitempty"`
+	AuthUser      string     `json:"auth_user,omitempty"`
+	DelayNotified bool       `json:"delay_notified"`
+	MailParams    string     `json:"mail_params,omitempty"`
+	RcptParams    []string   `json:"rcpt_params"`
+	LeaseOwner    string     `json:"lease_owner,omitempty"`
+	LeaseUntil    *time.Time `json:"lease_until,omitempty"`
+}
+
+// OpenSpool 打开spool目录，目录不存在时创建
+func OpenSpool(dir string) (*SpoolStore, error) {
+	if dir == "" {
+		return nil, errors.New("未配置spool目录")
+	}
+	for _, sub := range []string{"tmp", spoolNew, spoolActive, spoolDeferred, spoolFailed} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("创建spool目录时出错: %w", err)
+		}
+	}
+
+	return &SpoolStore{dir: dir}, nil
+}
+
+// 邮件文件路径，ext为 ".eml" 或 ".json"
+func (s *SpoolStore) path(state, queueID, ext string) string {
+	return filepath.Join(s.dir, state, queueID+ext)
+}
+
+// 写入信封文件
+func (s *SpoolStore) writeEnvelope(state string, email *Email) error {
+	data, err := json.Marshal(spoolEnvelope{
+		QueueID:       email.QueueID,
+		From:          email.From,
+		To:            email.To,
+		Subject:       email.Subject,
+		Created:       email.Created,
+		FailCount:     email.FailCount,
+		LastError:     email.LastError,
+		BodyType:      email.BodyType,
+		AuthUser:      email.AuthUser,
+		DelayNotified: email.DelayNotified,
+		MailParams:    email.MailParams,
+		RcptParams:    email.RcptParams,
+		LeaseOwner:    email.LeaseOwner,
+		LeaseUntil:    email.LeaseUntil,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, "tmp"), s.path(state, email.QueueID, ".json"), data)
+}
+
+// 读取信封文件，返回的邮件不包含邮件内容
+func (s *SpoolStore) readEnvelope(state, queueID string) (*Email, error) {
+	data, err := os.ReadFile(s.path(state, queueID, ".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var e spoolEnvelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("解析信封文件 %s/%s.json 时出错: %w", state, queueID, err)
+	}
+	if e.QueueID != queueID {
+		return nil, fmt.Errorf("信封文件 %s/%s.json 的队列标识不匹配: %s", state, queueID, e.QueueID)
+	}
+
+	return &Email{
+		QueueID:       e.QueueID,
+		From:          e.From,
+		To:            e.To,
+		Subject:       e.Subject,
+		Created:       e.Created,
+		FailCount:     e.FailCount,
+		LastError:     e.LastError,
+		BodyType:      e.BodyType,
+		AuthUser:      e.AuthUser,
+		DelayNotified: e.DelayNotified,
+		MailParams:    e.MailParams,
+		RcptParams:    e.RcptParams,
+		LeaseOwner:    e.LeaseOwner,
+		LeaseUntil:    e.LeaseUntil,
+	}, nil
+}
+
+// 读取邮件内容
+func (s *SpoolStore) readBody(state string, email *Email) error {
+	body, err := os.ReadFile(s.path(state, email.QueueID, ".eml"))
+	if err != nil {
+		return fmt.Errorf("读取邮件文件 %s/%s.eml 时出错: %w", state, email.QueueID, err)
+	}
+	email.Body = string(body)
+	return nil
+}
+
+// 列出状态目录中的队列标识
+func (s *SpoolStore) queueIDs(state, ext string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, state))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ext) {
+			ids = append(ids, strings.TrimSuffix(entry.Name(), ext))
+		}
+	}
+	return ids, nil
+}
+
+// 读取若干状态目录中全部邮件的信封，按入队时间排序
+//
+// 只读取信封文件，需要邮件内容时由调用方对选中的邮件调用readBody，
+// 避免队列积压时每次处理队列都读取全部邮件内容。
+// 无法读取的信封被跳过，quarantine为true时移到failed目录，不影响其他邮件的投递。
+// 其他进程（例如queue list）读取时可能遇到正在移动的邮件，因此只由投递邮件的进程隔离。
+func (s *SpoolStore) envelopes(quarantine bool, states ...string) ([]*Email, error) {
+	var emails []*Email
+	for _, state := range states {
+		ids, err := s.queueIDs(state, ".json")
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			email, err := s.readEnvelope(state, id)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				if quarantine {
+					if err := s.quarantine(state, id); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			emails = append(emails, email)
+		}
+	}
+	sortByCreated(emails)
+	return emails, nil
+}
+
+// 判断状态目录中是否存在邮件的信封文件
+func (s *SpoolStore) exists(state, queueID string) bool {
+	_, err := os.Stat(s.path(state, queueID, ".json"))
+	return err == nil
+}
+
+// 查找邮件所在的状态目录
+func (s *SpoolStore) locate(queueID string) (string, bool) {
+	for _, state := range spoolStates {
+		if s.exists(state, queueID) {
+			return state, true
+		}
+	}
+	return "", false
+}
+
+// 将邮件从一个状态目录移到另一个，先移动信封文件
+func (s *SpoolStore) move(queueID, from, to string) error {
+	if err := os.Rename(s.path(from, queueID, ".json"), s.path(to, queueID, ".json")); err != nil {
+		return err
+	}
+	return os.Rename(s.path(from, queueID, ".eml"), s.path(to, queueID, ".eml"))
+}
+
+// 删除邮件，先删除信封文件
+func (s *SpoolStore) remove(state, queueID string) error {
+	if err := os.Remove(s.path(state, queueID, ".json")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(s.path(state, queueID, ".eml")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// 将无法读取的邮件移到failed目录
+func (s *SpoolStore) quarantine(state, queueID string) error {
+	for _, ext := range []string{".json", ".eml"} {
+		err := os.Rename(s.path(state, queueID, ext), s.path(spoolFailed, queueID, ext))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// 返回租约仍由调用方持有的邮件所在的状态目录和信封
+func (s *SpoolStore) leased(email *Email) (string, *Email, error) {
+	state, ok := s.locate(email.QueueID)
+	if !ok {
+		return "", nil, ErrLeaseLost
+	}
+
+	stored, err := s.readEnvelope(state, email.QueueID)
+	if err != nil {
+		return "", nil, err
+	}
+	if stored.LeaseOwner != email.LeaseOwner {
+		return "", nil, ErrLeaseLost
+	}
+	return state, stored, nil
+}
+
+// 修改租约仍由调用方持有的邮件的信封并写回所在的状态目录
+func (s *SpoolStore) update(email *Email, fn func(*Email)) (string, error) {
+	state, stored, err := s.leased(email)
+	if err != nil {
+		return "", err
+	}
+
+	fn(stored)
+	if err := s.writeEnvelope(state, stored); err != nil {
+		return "", err
+	}
+	fn(email)
+	return state, nil
+}
+
+// 释放active目录中邮件的租约并移到deferred目录
+func (s *SpoolStore) release(email *Email) error {
+	email.LeaseOwner = ""
+	email.LeaseUntil = nil
+	if err := s.writeEnvelope(spoolActive, email); err != nil {
+		return err
+	}
+	return s.move(email.QueueID, spoolActive, spoolDeferred)
+}
+
+// 清理崩溃时残留的文件，并将仍在投递中的邮件放回deferred目录
+//
+// 没有信封文件的邮件内容来自未完成的入队或删除，直接删除；
+// 信封文件已移到其他状态目录的，将邮件内容也移过去。
+func (s *SpoolStore) recover() error {
+	for _, state := range spoolStates {
+		ids, err := s.queueIDs(state, ".eml")
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if s.exists(state, id) {
+				continue
+			}
+			path := s.path(state, id, ".eml")
+			if to, ok := s.locate(id); ok {
+				err = os.Rename(path, s.path(to, id, ".eml"))
+			} else {
+				err = os.Remove(path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	ids, err := s.queueIDs(spoolActive, ".json")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		email, err := s.readEnvelope(spoolActive, id)
+		if err != nil {
+			err = s.quarantine(spoolActive, id)
+		} else {
+			err = s.release(email)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// 清理未完成写入的临时文件
+	tmp, err := os.ReadDir(filepath.Join(s.dir, "tmp"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range tmp {
+		if err := os.Remove(filepath.Join(s.dir, "tmp", entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在状态目录中写入邮件内容和信封文件
+func (s *SpoolStore) write(state string, email *Email) error {
+	if err := writeFileAtomic(filepath.Join(s.dir, "tmp"), s.path(state, email.QueueID, ".eml"), []byte(email.Body)); err != nil {
+		return err
+	}
+	return s.writeEnvelope(state, email)
+}
+
+// Enqueue 将邮件写入new目录
+func (s *SpoolStore) Enqueue(email *Email) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if email.QueueID == "" {
+		email.QueueID = NewQueueID()
+	}
+	email.Created = time.Now()
+	return s.write(spoolNew, email)
+}
+
+// Claim 从new和deferred目录中取出等待发送的邮件，移到active目录并记录租约
+//
+// 首次调用时清理崩溃时残留的文件，并将上次退出时仍在投递中的邮件放回deferred目录。
+// 只在投递邮件的进程中执行，避免queue list等命令干扰正在运行的服务。
+func (s *SpoolStore) Claim(owner string, limit int, lease time.Duration) ([]*Email, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.recovered {
+		if err := s.recover(); err != nil {
+			return nil, fmt.Errorf("恢复spool目录时出错: %w", err)
+		}
+		s.recovered = true
+	}
+
+	emails, err := s.envelopes(true, spoolNew, spoolDeferred)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseUntil := time.Now().Add(lease)
+	var claimed []*Email
+	for _, email := range emails {
+		if len(claimed) >= limit {
+			break
+		}
+		state, ok := s.locate(email.QueueID)
+		if !ok {
+			continue
+		}
+		if err := s.readBody(state, email); err != nil {
+			if err := s.quarantine(state, email.QueueID); err != nil {
+				return claimed, err
+			}
+			continue
+		}
+		if err := s.move(email.QueueID, state, spoolActive); err != nil {
+			return claimed, err
+		}
+		email.LeaseOwner = owner
+		email.LeaseUntil = &leaseUntil
+		if err := s.writeEnvelope(spoolActive, email); err != nil {
+			return claimed, err
+		}
+		claimed = append(claimed, email)
+	}
+	return claimed, nil
+}
+
+// Reap 将active目录中租约已到期的邮件放回deferred目录
+func (s *SpoolStore) Reap() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	emails, err := s.envelopes(true, spoolActive)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	count := 0
+	for _, email := range emails {
+		// 没有租约的邮件来自移到active目录后未能写入租约的Claim
+		if email.LeaseOwner != "" && !leaseExpired(email, now) {
+			continue
+		}
+		if err := s.release(email); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Ack 确认邮件已发送并删除邮件文件
+func (s *SpoolStore) Ack(email *Email) error {
+	return s.Delete(email)
+}
+
+// Renew 延长邮件的租约
+func (s *SpoolStore) Renew(email *Email, lease time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	leaseUntil := time.Now().Add(lease)
+	_, err := s.update(email, func(e *Email) {
+		e.LeaseUntil = &leaseUntil
+	})
+	return err
+}
+
+// Fail 标记邮件发送失败并增加失败计数，释放租约并将邮件移到deferred目录等待重试
+func (s *SpoolStore) Fail(email *Email, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, err := s.update(email, func(e *Email) {
+		e.FailCount++
+		e.LastError = reason
+		e.LeaseOwner = ""
+		e.LeaseUntil = nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if state != spoolDeferred {
+		return s.move(email.QueueID, state, spoolDeferred)
+	}
+	return nil
+}
+
+// SetRecipients 替换信封中的收件人及其参数
+func (s *SpoolStore) SetRecipients(email *Email, to, rcptParams []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.update(email, func(e *Email) {
+		e.To = to
+		e.RcptParams = rcptParams
+	})
+	return err
+}
+
+// MarkDelayNotified 记录已向发件人发送延迟通知
+func (s *SpoolStore) MarkDelayNotified(email *Email) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.update(email, func(e *Email) {
+		e.DelayNotified = true
+	})
+	return err
+}
+
+// Delete 删除邮件文件
+func (s *SpoolStore) Delete(email *Email) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, _, err := s.leased(email)
+	if err != nil {
+		return err
+	}
+	return s.remove(state, email.QueueID)
+}
+
+// List 列出spool目录中的全部邮件
+func (s *SpoolStore) List() ([]*Email, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	envelopes, err := s.envelopes(false, spoolStates...)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := make([]*Email, 0, len(envelopes))
+	for _, email := range envelopes {
+		state, ok := s.locate(email.QueueID)
+		if !ok || s.readBody(state, email) != nil {
+			continue
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+// Cleanup 清理过老或失败次数过多的邮件，正在投递的邮件不会被清理
+func (s *SpoolStore) Cleanup(maxAge time.Duration, maxFailCount int) ([]*Email, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	emails, err := s.envelopes(true, spoolNew, spoolDeferred)
+	if err != nil {
+		return nil, err
+	}
+
+	oldTime := time.Now().Add(-maxAge)
+	var removed []*Email
+	for _, email := range emails {
+		if !expired(email, oldTime, maxFailCount) {
+			continue
+		}
+		state, ok := s.locate(email.QueueID)
+		if !ok {
+			continue
+		}
+		// 退信需要原始邮件头，内容无法读取时仍然删除
+		s.readBody(state, email)
+		if err := s.remove(state, email.QueueID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, email)
+	}
+	return removed, nil
+}
+
+// Close spool目录无需释放资源
+func (s *SpoolStore) Close() error {
+	return nil
+}
+
+// writeFileAtomic 先在tmpDir中写入并同步临时文件，再重命名为目标文件
+func writeFileAtomic(tmpDir, path string, data []byte) error {
+	f, err := os.CreateTemp(tmpDir, "spool-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
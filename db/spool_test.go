@@ -0,0 +1,104 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func openTestSpool(t *testing.T) *SpoolStore {
+	t.Helper()
+
+	store, err := OpenSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// 检查邮件的内容和信封文件是否位于指定的状态目录
+func assertSpoolState(t *testing.T, store *SpoolStore, queueID, state string) {
+	t.Helper()
+
+	for _, ext := range []string{".eml", ".json"} {
+		if _, err := os.Stat(store.path(state, queueID, ext)); err != nil {
+			t.Fatalf("%s%s 不在 %s 目录: %v", queueID, ext, state, err)
+		}
+	}
+}
+
+func TestSpoolLayout(t *testing.T) {
+	store := openTestSpool(t)
+	email := enqueue(t, store, "one")[0]
+	assertSpoolState(t, store, email.QueueID, spoolNew)
+
+	body, err := os.ReadFile(store.path(spoolNew, email.QueueID, ".eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != email.Body {
+		t.Fatalf("邮件内容 = %q，期望 %q", body, email.Body)
+	}
+
+	claimed := claim(t, store, "worker-1", 10, time.Minute)[0]
+	assertSpoolState(t, store, email.QueueID, spoolActive)
+
+	if err := store.Fail(claimed, "temporary"); err != nil {
+		t.Fatal(err)
+	}
+	assertSpoolState(t, store, email.QueueID, spoolDeferred)
+
+	claimed = claim(t, store, "worker-2", 10, time.Minute)[0]
+	assertSpoolState(t, store, email.QueueID, spoolActive)
+	if err := store.Ack(claimed); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.locate(email.QueueID); ok {
+		t.Fatal("确认后邮件仍在队列中")
+	}
+}
+
+func TestSpoolRecover(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := enqueue(t, store, "one")[0]
+	claim(t, store, "worker-1", 10, time.Minute)
+	store.Close()
+
+	// 模拟崩溃：邮件仍在active目录，并残留未完成入队的内容文件
+	store, err = OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	orphan := store.path(spoolNew, "orphan", ".eml")
+	if err := os.WriteFile(orphan, []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed := claim(t, store, "worker-1", 10, time.Minute)
+	if len(claimed) != 1 || claimed[0].QueueID != email.QueueID {
+		t.Fatalf("恢复后取出 %v，期望 [one]", subjects(claimed))
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("残留的内容文件未被删除: %v", err)
+	}
+}
+
+func TestSpoolQuarantine(t *testing.T) {
+	store := openTestSpool(t)
+	emails := enqueue(t, store, "broken", "good")
+	if err := os.WriteFile(store.path(spoolNew, emails[0].QueueID, ".json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed := claim(t, store, "worker-1", 10, time.Minute)
+	if got := subjects(claimed); len(got) != 1 || got[0] != "good" {
+		t.Fatalf("取出 %v，期望 [good]", got)
+	}
+	assertSpoolState(t, store, emails[0].QueueID, spoolFailed)
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// 队列存储类型
+const (
+	StoreSQLite   = "sqlite"   // SQLite数据库
+	StoreMemory   = "memory"   // 内存，进程退出后队列丢失，仅用于测试
+	StoreSpool    = "spool"    // 文件系统目录，每封邮件一个文件
+	StorePostgres = "postgres" // PostgreSQL数据库，多个实例可以共享同一个队列
+)
+
+// ErrLeaseLost 表示调用方已不再持有邮件的租约：租约到期后已被放回队列或被其他工作者取出，
+// 或者邮件已不在队列中
+var ErrLeaseLost = errors.New("邮件租约已失效")
+
+// Store 是邮件队列的存储接口
+//
+// 服务器通过Enqueue写入邮件，工作者通过Claim取出邮件，投递后调用Ack、Fail或Delete更新状态。
+// Claim为取出的邮件记录租约，持有租约的邮件不会被再次取出；工作者在投递过程中退出时，
+// 租约到期后由Reap将邮件放回队列。
+//
+// Renew、Ack、Fail、SetRecipients、MarkDelayNotified和Delete只在存储中邮件的租约持有者仍为email.LeaseOwner时生效
+// （未取出的邮件持有者为空），否则返回ErrLeaseLost，避免过期的工作者修改已被其他工作者取出的邮件。
+// 实现必须允许并发调用。
+type Store interface {
+	// Enqueue 将邮件加入队列，未指定队列标识时自动生成并写回email.QueueID
+	Enqueue(email *Email) error
+
+	// Claim 以owner的名义取出最多limit封等待投递的邮件并记录租约，租约在lease后到期，
+	// 按入队时间排序。取出和记录租约是原子的，同一封邮件不会被两个工作者同时取出
+	Claim(owner string, limit int, lease time.Duration) ([]*Email, error)
+
+	// Reap 将租约已到期的邮件放回队列，返回放回的邮件数量
+	Reap() (int, error)
+
+	// Renew 将邮件的租约延长到lease之后到期，并更新email.LeaseUntil
+	Renew(email *Email, lease time.Duration) error
+
+	// Ack 确认邮件已投递成功，并将其从队列中删除
+	Ack(email *Email) error
+
+	// Fail 记录一次投递失败，增加失败计数并保存错误信息，同时释放租约
+	Fail(email *Email, reason string) error
+
+	// SetRecipients 将邮件的收件人替换为to，rcptParams为对应的ESMTP参数。
+	// 部分收件人已投递或被永久拒绝后，只保留需要重试的收件人
+	SetRecipients(email *Email, to, rcptParams []string) error
+
+	// MarkDelayNotified 记录已向发件人发送延迟通知
+	MarkDelayNotified(email *Email) error
+
+	// Delete 从队列中删除邮件
+	Delete(email *Email) error
+
+	// List 列出队列中的全部邮件，按入队时间排序
+	List() ([]*Email, error)
+
+	// Cleanup 删除创建时间超过maxAge或失败次数达到maxFailCount的邮件，返回被删除的邮件。
+	// 持有租约的邮件不会被删除
+	Cleanup(maxAge time.Duration, maxFailCount int) ([]*Email, error)
+
+	// Close 释放存储占用的资源
+	Close() error
+}
+
+// Migrator 是需要结构迁移的队列存储
+type Migrator interface {
+	// Migrate 执行尚未执行的迁移，返回本次执行的迁移数量
+	Migrate() (int, error)
+
+	// MigrationStatus 返回全部迁移的执行状态
+	MigrationStatus() ([]MigrationStatus, error)
+
+	// Close 释放存储占用的资源
+	Close() error
+}
+
+var (
+	_ Migrator = (*DB)(nil)
+	_ Migrator = (*PostgresStore)(nil)
+)
+
+// OpenStore 按类型打开队列存储，path为SQLite数据库文件、spool目录或PostgreSQL连接字符串，内存存储忽略path
+func OpenStore(kind, path string) (Store, error) {
+	switch kind {
+	case StoreSQLite:
+		return Init(path)
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	case StoreSpool:
+		return OpenSpool(path)
+	case StorePostgres:
+		return OpenPostgres(path)
+	default:
+		return nil, fmt.Errorf("未知的队列存储类型: %q", kind)
+	}
+}
+
+// 判断邮件是否应被清理，持有租约的邮件正在投递，不清理
+func expired(email *Email, oldTime time.Time, maxFailCount int) bool {
+	if email.LeaseOwner != "" {
+		return false
+	}
+	return email.FailCount >= maxFailCount || email.Created.Before(oldTime)
+}
+
+// 判断租约是否已到期
+func leaseExpired(email *Email, now time.Time) bool {
+	return email.LeaseOwner != "" && (email.LeaseUntil == nil || email.LeaseUntil.Before(now))
+}
+
+// 按入队时间排序，时间相同时按队列标识排序以保证顺序稳定
+func sortByCreated(emails []*Email) {
+	sort.Slice(emails, func(i, j int) bool {
+		if !emails[i].Created.Equal(emails[j].Created) {
+			return emails[i].Created.Before(emails[j].Created)
+		}
+		return emails[i].QueueID < emails[j].QueueID
+	})
+}
+
+// 复制邮件，避免调用方修改存储内部的数据
+func cloneEmail(email *Email) *Email {
+	c := *email
+	c.To = append([]string(nil), email.To...)
+	c.RcptParams = append([]string(nil), email.RcptParams...)
+	if email.SentAt != nil {
+		sentAt := *email.SentAt
+		c.SentAt = &sentAt
+	}
+	if email.LeaseUntil != nil {
+		leaseUntil := *email.LeaseUntil
+		c.LeaseUntil = &leaseUntil
+	}
+	return &c
+}
@@ -0,0 +1,435 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 各存储实现共用的一致性测试
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		StoreMemory: func(t *testing.T) Store {
+			return NewMemoryStore()
+		},
+		StoreSQLite: func(t *testing.T) Store {
+			store, err := Init(filepath.Join(t.TempDir(), "queue.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+		StoreSpool: func(t *testing.T) Store {
+			store, err := OpenSpool(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+		StorePostgres: openTestPostgres,
+	}
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store Store)
+	}{
+		{"EnqueueList", testEnqueueList},
+		{"Claim", testClaim},
+		{"Fail", testFail},
+		{"SetRecipients", testSetRecipients},
+		{"Ack", testAck},
+		{"LeaseLost", testLeaseLost},
+		{"Reap", testReap},
+		{"Cleanup", testCleanup},
+	}
+
+	for kind, open := range stores {
+		for _, tt := range tests {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				store := open(t)
+				defer store.Close()
+				tt.run(t, store)
+			})
+		}
+	}
+}
+
+// 连接POSTGRES_TEST_DSN指定的测试数据库并清空队列，未设置时跳过测试
+func openTestPostgres(t *testing.T) Store {
+	t.Helper()
+
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("未设置POSTGRES_TEST_DSN")
+	}
+	store, err := OpenPostgres(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec("DELETE FROM emails"); err != nil {
+		store.Close()
+		t.Fatal(err)
+	}
+	return store
+}
+
+// 将测试邮件加入队列，邮件按加入顺序排列
+func enqueue(t *testing.T, store Store, subjects ...string) []*Email {
+	t.Helper()
+
+	var emails []*Email
+	for _, subject := range subjects {
+		email := &Email{
+			From:       "sender@example.com",
+			To:         []string{`"a;b"@example.com`, "c@example.com"},
+			Subject:    subject,
+			Body:       "Subject: " + subject + "\r\n\r\nbody\r\n",
+			BodyType:   "8BITMIME",
+			AuthUser:   "user",
+			MailParams: "RET=HDRS ENVID=QQ314159",
+			RcptParams: []string{"NOTIFY=SUCCESS ORCPT=rfc822;a+3Bb@example.com", ""},
+		}
+		if err := store.Enqueue(email); err != nil {
+			t.Fatal(err)
+		}
+		emails = append(emails, email)
+		// 保证创建时间各不相同，队列按创建时间排序
+		time.Sleep(time.Millisecond)
+	}
+	return emails
+}
+
+// 返回邮件主题列表，用于比较顺序
+func subjects(emails []*Email) []string {
+	result := make([]string, len(emails))
+	for i, email := range emails {
+		result[i] = email.Subject
+	}
+	return result
+}
+
+func claim(t *testing.T, store Store, owner string, limit int, lease time.Duration) []*Email {
+	t.Helper()
+
+	emails, err := store.Claim(owner, limit, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emails
+}
+
+func list(t *testing.T, store Store) []*Email {
+	t.Helper()
+
+	emails, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emails
+}
+
+func testEnqueueList(t *testing.T, store Store) {
+	enqueued := enqueue(t, store, "one", "two")
+	if enqueued[0].QueueID == "" || enqueued[0].QueueID == enqueued[1].QueueID {
+		t.Fatalf("队列标识无效: %q, %q", enqueued[0].QueueID, enqueued[1].QueueID)
+	}
+
+	emails := list(t, store)
+	if got := subjects(emails); !slices.Equal(got, []string{"one", "two"}) {
+		t.Fatalf("List() = %v", got)
+	}
+
+	got, want := emails[0], enqueued[0]
+	if got.QueueID != want.QueueID || got.From != want.From || got.Body != want.Body ||
+		got.BodyType != want.BodyType || got.AuthUser != want.AuthUser || got.MailParams != want.MailParams {
+		t.Errorf("List() = %+v, want %+v", got, want)
+	}
+	if !slices.Equal(got.To, want.To) {
+		t.Errorf("To = %q, want %q", got.To, want.To)
+	}
+	if !slices.Equal(got.RcptParams, want.RcptParams) {
+		t.Errorf("RcptParams = %q, want %q", got.RcptParams, want.RcptParams)
+	}
+	if got.Sent || got.FailCount != 0 || got.DelayNotified || got.LeaseOwner != "" {
+		t.Errorf("新邮件的状态无效: %+v", got)
+	}
+}
+
+func testClaim(t *testing.T, store Store) {
+	enqueue(t, store, "one", "two", "three")
+
+	first := claim(t, store, "worker-1", 2, time.Minute)
+	if got := subjects(first); !slices.Equal(got, []string{"one", "two"}) {
+		t.Fatalf("Claim() = %v", got)
+	}
+	for _, email := range first {
+		if email.LeaseOwner != "worker-1" || email.LeaseUntil == nil || email.Body == "" || len(email.To) != 2 {
+			t.Errorf("取出的邮件无效: %+v", email)
+		}
+	}
+
+	// 持有租约的邮件不会被再次取出
+	second := claim(t, store, "worker-2", 10, time.Minute)
+	if got := subjects(second); !slices.Equal(got, []string{"three"}) {
+		t.Fatalf("Claim() = %v", got)
+	}
+	if emails := claim(t, store, "worker-3", 10, time.Minute); len(emails) != 0 {
+		t.Fatalf("Claim() = %v, want none", subjects(emails))
+	}
+
+	// List 显示租约
+	for _, email := range list(t, store) {
+		if email.LeaseOwner == "" {
+			t.Errorf("邮件 %s 缺少租约", email.Subject)
+		}
+	}
+
+	// 续约延长到期时间
+	email := first[0]
+	before := *email.LeaseUntil
+	if err := store.Renew(email, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !email.LeaseUntil.After(before) {
+		t.Errorf("Renew() 后租约到期时间 %v 未晚于 %v", email.LeaseUntil, before)
+	}
+
+	// 投递成功的邮件从队列中删除
+	if err := store.Ack(first[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := subjects(list(t, store)); !slices.Equal(got, []string{"two", "three"}) {
+		t.Fatalf("List() = %v", got)
+	}
+}
+
+func testFail(t *testing.T, store Store) {
+	enqueue(t, store, "one")
+
+	email := claim(t, store, "worker-1", 1, time.Minute)[0]
+	if err := store.MarkDelayNotified(email); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Fail(email, "451 try again"); err != nil {
+		t.Fatal(err)
+	}
+	if email.FailCount != 1 || email.LastError != "451 try again" || email.LeaseOwner != "" || !email.DelayNotified {
+		t.Errorf("Fail() 后的邮件无效: %+v", email)
+	}
+
+	// 失败后释放租约，可以再次取出
+	retried := claim(t, store, "worker-2", 1, time.Minute)
+	if len(retried) != 1 {
+		t.Fatalf("Claim() 返回 %d 封邮件，want 1", len(retried))
+	}
+	got := retried[0]
+	if got.FailCount != 1 || got.LastError != "451 try again" || !got.DelayNotified || got.LeaseOwner != "worker-2" {
+		t.Errorf("再次取出的邮件无效: %+v", got)
+	}
+}
+
+func testSetRecipients(t *testing.T, store Store) {
+	enqueue(t, store, "one")
+
+	email := claim(t, store, "worker-1", 1, time.Minute)[0]
+	to, params := []string{"c@example.com"}, []string{"NOTIFY=FAILURE"}
+	if err := store.SetRecipients(email, to, params); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Fail(email, "451 try again"); err != nil {
+		t.Fatal(err)
+	}
+	// 修改调用方的切片不影响队列中的邮件
+	to[0] = "changed@example.com"
+
+	got := claim(t, store, "worker-2", 1, time.Minute)[0]
+	if !slices.Equal(got.To, []string{"c@example.com"}) || !slices.Equal(got.RcptParams, params) {
+		t.Errorf("SetRecipients() 后的收件人 = %q, %q", got.To, got.RcptParams)
+	}
+	if got.FailCount != 1 || got.Body == "" {
+		t.Errorf("SetRecipients() 修改了其他字段: %+v", got)
+	}
+}
+
+func testAck(t *testing.T, store Store) {
+	enqueue(t, store, "one", "two")
+
+	emails := claim(t, store, "worker-1", 2, time.Minute)
+	if err := store.Ack(emails[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(emails[1]); err != nil {
+		t.Fatal(err)
+	}
+	if emails := list(t, store); len(emails) != 0 {
+		t.Errorf("List() = %v, want empty", subjects(emails))
+	}
+}
+
+func testLeaseLost(t *testing.T, store Store) {
+	enqueue(t, store, "one")
+
+	// 租约到期后被回收并由其他工作者取出
+	stale := claim(t, store, "worker-1", 1, -time.Second)[0]
+	if _, err := store.Reap(); err != nil {
+		t.Fatal(err)
+	}
+	current := claim(t, store, "worker-2", 1, time.Minute)[0]
+
+	operations := map[string]func(*Email) error{
+		"Renew":             func(e *Email) error { return store.Renew(e, time.Minute) },
+		"Fail":              func(e *Email) error { return store.Fail(e, "timeout") },
+		"SetRecipients":     func(e *Email) error { return store.SetRecipients(e, []string{"c@example.com"}, []string{""}) },
+		"MarkDelayNotified": store.MarkDelayNotified,
+		"Ack":               store.Ack,
+		"Delete":            store.Delete,
+	}
+	for name, op := range operations {
+		if err := op(stale); !errors.Is(err, ErrLeaseLost) {
+			t.Errorf("过期工作者的 %s() error = %v, want ErrLeaseLost", name, err)
+		}
+	}
+
+	// 过期工作者的操作不影响当前持有者
+	email := list(t, store)[0]
+	if email.LeaseOwner != "worker-2" || email.FailCount != 0 || email.DelayNotified {
+		t.Errorf("邮件被过期工作者修改: %+v", email)
+	}
+
+	if err := store.Ack(current); err != nil {
+		t.Fatal(err)
+	}
+
+	// 邮件已不在队列中
+	if err := store.Delete(current); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("删除不存在的邮件 error = %v, want ErrLeaseLost", err)
+	}
+}
+
+func testReap(t *testing.T, store Store) {
+	enqueue(t, store, "expired", "active")
+
+	claim(t, store, "worker-1", 1, -time.Second)
+	claim(t, store, "worker-2", 1, time.Minute)
+
+	count, err := store.Reap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Reap() = %d, want 1", count)
+	}
+
+	// 只有租约到期的邮件回到队列
+	emails := claim(t, store, "worker-3", 10, time.Minute)
+	if got := subjects(emails); !slices.Equal(got, []string{"expired"}) {
+		t.Errorf("Claim() = %v, want [expired]", got)
+	}
+}
+
+func testCleanup(t *testing.T, store Store) {
+	enqueue(t, store, "failed", "leased", "pending")
+
+	// 失败两次的邮件
+	for i := 0; i < 2; i++ {
+		email := claim(t, store, "worker-1", 1, time.Minute)[0]
+		if err := store.Fail(email, "451 try again"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 正在投递的邮件即使已过期也不清理
+	leased := claim(t, store, "worker-1", 2, time.Minute)
+	if got := subjects(leased); !slices.Equal(got, []string{"failed", "leased"}) {
+		t.Fatalf("Claim() = %v", got)
+	}
+	if err := store.Fail(leased[0], "451 try again"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.Cleanup(time.Hour, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := subjects(removed); !slices.Equal(got, []string{"failed"}) {
+		t.Errorf("Cleanup() = %v, want [failed]", got)
+	}
+	if len(removed) == 1 && removed[0].LastError != "451 try again" {
+		t.Errorf("清理的邮件缺少错误信息: %+v", removed[0])
+	}
+
+	// 超过最长保留时间的邮件
+	removed, err = store.Cleanup(-time.Second, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := subjects(removed); !slices.Equal(got, []string{"pending"}) {
+		t.Errorf("Cleanup() = %v, want [pending]", got)
+	}
+
+	if got := subjects(list(t, store)); !slices.Equal(got, []string{"leased"}) {
+		t.Errorf("List() = %v, want [leased]", got)
+	}
+}
+
+// 多个实例同时认领时，同一封邮件只会被一个实例取出
+func TestPostgresConcurrentClaim(t *testing.T) {
+	first := openTestPostgres(t).(*PostgresStore)
+	defer first.Close()
+	second := openTestPostgres(t).(*PostgresStore)
+	defer second.Close()
+
+	const total = 100
+	for i := 0; i < total; i++ {
+		email := &Email{From: "sender@example.com", To: []string{"rcpt@example.com"}, Subject: fmt.Sprintf("mail-%03d", i), Body: "body"}
+		if err := first.Enqueue(email); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		claimed = make(map[int64]int)
+		wg      sync.WaitGroup
+		errs    = make(chan error, 2)
+	)
+	for i, store := range []*PostgresStore{first, second} {
+		wg.Add(1)
+		go func(owner string, store *PostgresStore) {
+			defer wg.Done()
+			for {
+				emails, err := store.Claim(owner, 3, time.Minute)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(emails) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, email := range emails {
+					claimed[email.ID]++
+				}
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("worker-%d", i+1), store)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if len(claimed) != total {
+		t.Errorf("认领了 %d 封邮件，期望 %d 封", len(claimed), total)
+	}
+	for id, count := range claimed {
+		if count > 1 {
+			t.Errorf("邮件 %d 被认领了 %d 次", id, count)
+		}
+	}
+}
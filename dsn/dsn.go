@@ -0,0 +1,191 @@
+// Package dsn 实现投递状态通知（DSN，RFC 3461）的ESMTP参数解析
+package dsn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NOTIFY 参数的取值
+const (
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+// RET 参数的取值
+const (
+	RetFull = "FULL"
+	RetHdrs = "HDRS"
+)
+
+// ENVID 的最大长度（RFC 3461 4.4）
+const maxEnvIDLength = 100
+
+var errInvalidXtext = errors.New("无效的xtext编码")
+
+// MailParams 是 MAIL FROM 中与DSN相关的参数
+type MailParams struct {
+	Ret   string // FULL、HDRS，未指定时为空
+	EnvID string // xtext编码的原始信封ID，未指定时为空
+}
+
+// RcptParams 是 RCPT TO 中与DSN相关的参数
+type RcptParams struct {
+	Notify []string // 未指定时为空
+	ORCPT  string   // 原始参数值，格式为 "addr-type;xtext"，未指定时为空
+}
+
+// ParseMailParams 从以空格分隔的 MAIL FROM 参数中提取DSN参数
+func ParseMailParams(params string) MailParams {
+	var p MailParams
+	for _, field := range strings.Fields(params) {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToUpper(key) {
+		case "RET":
+			p.Ret = strings.ToUpper(value)
+		case "ENVID":
+			p.EnvID = value
+		}
+	}
+	return p
+}
+
+// ParseRcptParams 从以空格分隔的 RCPT TO 参数中提取DSN参数
+func ParseRcptParams(params string) RcptParams {
+	var p RcptParams
+	for _, field := range strings.Fields(params) {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToUpper(key) {
+		case "NOTIFY":
+			p.Notify, _ = ParseNotify(value)
+		case "ORCPT":
+			p.ORCPT = value
+		}
+	}
+	return p
+}
+
+// Wants 判断收件人是否要求指定类型的通知
+//
+// 未指定NOTIFY时由实现决定，这里只在投递失败时通知（即退信）。
+func (p RcptParams) Wants(notify string) bool {
+	if len(p.Notify) == 0 {
+		return notify == NotifyFailure
+	}
+	for _, n := range p.Notify {
+		if n == notify {
+			return true
+		}
+	}
+	return false
+}
+
+// OriginalRecipient 返回解码后的ORCPT，格式为 "addr-type; address"，未指定时为空
+func (p RcptParams) OriginalRecipient() string {
+	addrType, xtext, ok := strings.Cut(p.ORCPT, ";")
+	if !ok {
+		return ""
+	}
+	addr, err := DecodeXtext(xtext)
+	if err != nil {
+		return ""
+	}
+	return addrType + "; " + addr
+}
+
+// ParseNotify 解析并校验NOTIFY参数
+//
+// NEVER 必须单独出现，其他取值可以用逗号组合。
+func ParseNotify(value string) ([]string, error) {
+	if value == "" {
+		return nil, fmt.Errorf("NOTIFY 不能为空")
+	}
+
+	var notify []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(strings.ToUpper(value), ",") {
+		switch item {
+		case NotifyNever, NotifySuccess, NotifyFailure, NotifyDelay:
+		default:
+			return nil, fmt.Errorf("未知的NOTIFY取值: %q", item)
+		}
+		if seen[item] {
+			return nil, fmt.Errorf("重复的NOTIFY取值: %q", item)
+		}
+		seen[item] = true
+		notify = append(notify, item)
+	}
+
+	if seen[NotifyNever] && len(notify) > 1 {
+		return nil, fmt.Errorf("NOTIFY=NEVER 不能与其他取值组合")
+	}
+	return notify, nil
+}
+
+// ValidRet 校验RET参数
+func ValidRet(value string) bool {
+	switch strings.ToUpper(value) {
+	case RetFull, RetHdrs:
+		return true
+	}
+	return false
+}
+
+// ValidEnvID 校验ENVID参数
+func ValidEnvID(value string) bool {
+	if value == "" || len(value) > maxEnvIDLength {
+		return false
+	}
+	_, err := DecodeXtext(value)
+	return err == nil
+}
+
+// ValidORCPT 校验ORCPT参数，格式为 "addr-type;xtext"
+func ValidORCPT(value string) bool {
+	addrType, xtext, ok := strings.Cut(value, ";")
+	if !ok || addrType == "" || xtext == "" {
+		return false
+	}
+	_, err := DecodeXtext(xtext)
+	return err == nil
+}
+
+// DecodeXtext 解码xtext（RFC 3461 4），"+XX" 表示十六进制编码的字节
+func DecodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) {
+				return "", errInvalidXtext
+			}
+			hi, ok1 := unhex(s[i+1])
+			lo, ok2 := unhex(s[i+2])
+			if !ok1 || !ok2 {
+				return "", errInvalidXtext
+			}
+			b.WriteByte(hi<<4 | lo)
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", errInvalidXtext
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// xtext 只允许大写的十六进制字符
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
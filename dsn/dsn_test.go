@@ -0,0 +1,136 @@
+package dsn
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDecodeXtext(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: ""},
+		{in: "user@example.com", want: "user@example.com"},
+		{in: "a+2Bb", want: "a+b"},
+		{in: "a+3Db", want: "a=b"},
+		{in: "a+3db", wantErr: true},
+		{in: "+E4+BD+A0", want: "你"},
+		{in: "a+2", wantErr: true},
+		{in: "a+", wantErr: true},
+		{in: "a+ZZ", wantErr: true},
+		{in: "a=b", wantErr: true},
+		{in: "a b", wantErr: true},
+		{in: "\x7f", wantErr: true},
+		{in: "你", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := DecodeXtext(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("DecodeXtext(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("DecodeXtext(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseNotify(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "NEVER", want: []string{NotifyNever}},
+		{in: "success,failure", want: []string{NotifySuccess, NotifyFailure}},
+		{in: "SUCCESS,FAILURE,DELAY", want: []string{NotifySuccess, NotifyFailure, NotifyDelay}},
+		{in: "", wantErr: true},
+		{in: "NEVER,SUCCESS", wantErr: true},
+		{in: "FAILURE,FAILURE", wantErr: true},
+		{in: "ALWAYS", wantErr: true},
+		{in: "SUCCESS,", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseNotify(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseNotify(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseNotify(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid func(string) bool
+		in    string
+		want  bool
+	}{
+		{"RET", ValidRet, "FULL", true},
+		{"RET", ValidRet, "hdrs", true},
+		{"RET", ValidRet, "BODY", false},
+		{"RET", ValidRet, "", false},
+		{"ENVID", ValidEnvID, "QQ314159", true},
+		{"ENVID", ValidEnvID, "a+2Bb", true},
+		{"ENVID", ValidEnvID, "", false},
+		{"ENVID", ValidEnvID, "a+zz", false},
+		{"ENVID", ValidEnvID, string(make([]byte, maxEnvIDLength+1)), false},
+		{"ORCPT", ValidORCPT, "rfc822;user@example.com", true},
+		{"ORCPT", ValidORCPT, "rfc822;a+2Bb@example.com", true},
+		{"ORCPT", ValidORCPT, "user@example.com", false},
+		{"ORCPT", ValidORCPT, "rfc822;", false},
+		{"ORCPT", ValidORCPT, ";user@example.com", false},
+		{"ORCPT", ValidORCPT, "rfc822;a=b", false},
+	}
+	for _, tt := range tests {
+		if got := tt.valid(tt.in); got != tt.want {
+			t.Errorf("Valid%s(%q) = %v, want %v", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMailParams(t *testing.T) {
+	got := ParseMailParams("BODY=8BITMIME ret=hdrs ENVID=QQ314159")
+	want := MailParams{Ret: RetHdrs, EnvID: "QQ314159"}
+	if got != want {
+		t.Errorf("ParseMailParams() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRcptParams(t *testing.T) {
+	tests := []struct {
+		params   string
+		wants    map[string]bool
+		original string
+	}{
+		{
+			params: "",
+			wants:  map[string]bool{NotifySuccess: false, NotifyFailure: true, NotifyDelay: false},
+		},
+		{
+			params:   "NOTIFY=SUCCESS,DELAY ORCPT=rfc822;a+2Bb@example.com",
+			wants:    map[string]bool{NotifySuccess: true, NotifyFailure: false, NotifyDelay: true},
+			original: "rfc822; a+b@example.com",
+		},
+		{
+			params: "NOTIFY=NEVER ORCPT=invalid",
+			wants:  map[string]bool{NotifySuccess: false, NotifyFailure: false, NotifyDelay: false},
+		},
+	}
+	for _, tt := range tests {
+		p := ParseRcptParams(tt.params)
+		for notify, want := range tt.wants {
+			if got := p.Wants(notify); got != want {
+				t.Errorf("ParseRcptParams(%q).Wants(%s) = %v, want %v", tt.params, notify, got, want)
+			}
+		}
+		if got := p.OriginalRecipient(); got != tt.original {
+			t.Errorf("ParseRcptParams(%q).OriginalRecipient() = %q, want %q", tt.params, got, tt.original)
+		}
+	}
+}
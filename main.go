@@ -7,7 +7,6 @@ import (
 	"syscall"
 
 	"github.com/ivampiresp/smtp-queue/config"
-	"github.com/ivampiresp/smtp-queue/db"
 	"github.com/ivampiresp/smtp-queue/server"
 	"github.com/ivampiresp/smtp-queue/worker"
 	"github.com/rs/zerolog"
@@ -24,23 +23,31 @@ func main() {
 		log.Fatal().Err(err).Msg("无法加载配置")
 	}
 
-	// 初始化数据库
-	database, err := db.Init(cfg.DBPath)
+	// 命令行子命令，例如 "migrate status"
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, os.Args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("命令执行失败")
+		}
+		return
+	}
+
+	// 打开队列存储，SQLite存储在启动时自动执行尚未执行的结构迁移
+	store, err := openStore(cfg)
 	if err != nil {
-		log.Fatal().Err(err).Msg("无法初始化数据库")
+		log.Fatal().Err(err).Msg("无法初始化队列存储")
 	}
-	defer database.Close()
+	defer store.Close()
 
 	// 创建上下文，用于优雅关闭
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// 启动工作者（负责发送队列中的邮件）
-	w := worker.New(database, cfg)
+	w := worker.New(store, cfg)
 	go w.Start(ctx)
 
 	// 启动SMTP服务器
-	s := server.New(database, cfg)
+	s := server.New(store, cfg)
 	go func() {
 		if err := s.Start(); err != nil {
 			log.Error().Err(err).Msg("SMTP服务器错误")
@@ -49,7 +56,8 @@ func main() {
 	}()
 
 	log.Info().
-		Str("listen_addr", cfg.ListenAddr).
+		Int("listeners", len(cfg.Listeners)).
+		Str("store", cfg.QueueStore).
 		Msg("SMTP队列服务器已启动")
 
 	// 等待中断信号以优雅地关闭服务器
@@ -0,0 +1,123 @@
+// Package message 处理RFC 5322格式邮件的头部分
+package message
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// SplitHeader 将邮件拆分为头部分（每行以换行符结尾）和其余部分（从分隔头部分和正文的空行开始）
+//
+// 遇到既不是头字段也不是续行的行时，认为邮件缺少分隔空行，在该行之前补充空行。
+// 邮件不以头字段开头时头部分为空。
+func SplitHeader(body string) (header, rest string) {
+	offset := 0
+	for offset < len(body) {
+		line := body[offset:]
+		end := strings.IndexByte(line, '\n')
+		if end >= 0 {
+			line = line[:end+1]
+		}
+
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			return body[:offset], body[offset:]
+		}
+		if !isHeaderLine(trimmed, offset == 0) {
+			return body[:offset], "\r\n" + body[offset:]
+		}
+
+		if end < 0 {
+			// 最后一行没有换行符，整封邮件只有头部分
+			return body + "\r\n", ""
+		}
+		offset += end + 1
+	}
+	return body, ""
+}
+
+// ReadHeader 从r中读取邮件的头部分，规则与SplitHeader相同
+//
+// 返回头部分和读到的头部分之后的第一行（分隔空行，或补充了分隔空行的正文第一行），
+// 其余内容留在r中，调用方无需将整封邮件读入内存即可处理头部分。
+func ReadHeader(r *bufio.Reader) (header, next string, err error) {
+	var b strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", "", err
+		}
+		if line == "" {
+			return b.String(), "", nil
+		}
+
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			return b.String(), line, nil
+		}
+		if !isHeaderLine(trimmed, b.Len() == 0) {
+			return b.String(), "\r\n" + line, nil
+		}
+
+		b.WriteString(line)
+		if err == io.EOF {
+			// 最后一行没有换行符，整封邮件只有头部分
+			b.WriteString("\r\n")
+			return b.String(), "", nil
+		}
+	}
+}
+
+// 判断一行是否是头字段或头字段的续行，第一行不能是续行
+func isHeaderLine(line string, first bool) bool {
+	if line[0] == ' ' || line[0] == '\t' {
+		return !first
+	}
+	name, _, ok := strings.Cut(line, ":")
+	return ok && name != "" && !strings.ContainsAny(name, " \t")
+}
+
+// HasHeader 判断头部分中是否存在指定的头（不区分大小写）
+func HasHeader(header, name string) bool {
+	prefix := strings.ToLower(name) + ":"
+	for _, line := range strings.Split(header, "\n") {
+		if strings.HasPrefix(strings.ToLower(line), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetHeader 将头部分中指定的头替换为新的值，返回新的头部分
+//
+// 第一个同名头字段（连同续行）替换为新值，其余同名头字段被删除；不存在时加在头部分末尾。
+func SetHeader(header, name, value string) string {
+	prefix := strings.ToLower(name) + ":"
+	field := name + ": " + value + "\r\n"
+
+	var b strings.Builder
+	replaced, skipping := false, false
+	for _, line := range strings.SplitAfter(header, "\n") {
+		if line == "" {
+			continue
+		}
+		if skipping && (line[0] == ' ' || line[0] == '\t') {
+			continue
+		}
+
+		skipping = strings.HasPrefix(strings.ToLower(line), prefix)
+		if !skipping {
+			b.WriteString(line)
+			continue
+		}
+		if !replaced {
+			b.WriteString(field)
+			replaced = true
+		}
+	}
+	if !replaced {
+		b.WriteString(field)
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package message
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSplitHeader(t *testing.T) {
+	tests := []struct {
+		body   string
+		header string
+		rest   string
+	}{
+		{body: "Subject: a\r\nX: b\r\n\r\nbody\r\n", header: "Subject: a\r\nX: b\r\n", rest: "\r\nbody\r\n"},
+		{body: "Subject: a\r\n\tcontinued\r\n\r\nbody", header: "Subject: a\r\n\tcontinued\r\n", rest: "\r\nbody"},
+		{body: "Subject: a\nX: b\n\nbody\n", header: "Subject: a\nX: b\n", rest: "\nbody\n"},
+		{body: "Subject: a\r\nnot a header\r\n", header: "Subject: a\r\n", rest: "\r\nnot a header\r\n"},
+		{body: "just text\r\n", header: "", rest: "\r\njust text\r\n"},
+		{body: " folded\r\n\r\nbody", header: "", rest: "\r\n folded\r\n\r\nbody"},
+		{body: "\r\nbody", header: "", rest: "\r\nbody"},
+		{body: "Subject: a", header: "Subject: a\r\n", rest: ""},
+		{body: "", header: "", rest: ""},
+	}
+	for _, tt := range tests {
+		header, rest := SplitHeader(tt.body)
+		if header != tt.header || rest != tt.rest {
+			t.Errorf("SplitHeader(%q) = %q, %q, want %q, %q", tt.body, header, rest, tt.header, tt.rest)
+		}
+
+		// ReadHeader与SplitHeader的结果一致
+		r := bufio.NewReader(strings.NewReader(tt.body))
+		header, next, err := ReadHeader(r)
+		if err != nil {
+			t.Errorf("ReadHeader(%q) error = %v", tt.body, err)
+			continue
+		}
+		remaining, _ := io.ReadAll(r)
+		if header != tt.header || next+string(remaining) != tt.rest {
+			t.Errorf("ReadHeader(%q) = %q, %q, want %q, %q", tt.body, header, next+string(remaining), tt.header, tt.rest)
+		}
+	}
+}
+
+func TestHasHeader(t *testing.T) {
+	header := "Subject: a\r\nmessage-id: <1@example.com>\r\n\tDate: folded\r\n"
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Message-ID", true},
+		{"Subject", true},
+		{"Date", false},
+		{"Sub", false},
+	}
+	for _, tt := range tests {
+		if got := HasHeader(header, tt.name); got != tt.want {
+			t.Errorf("HasHeader(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{
+			header: "Received: from a\r\nFrom: old@example.com\r\nSubject: s\r\n",
+			want:   "Received: from a\r\nFrom: relay@example.com\r\nSubject: s\r\n",
+		},
+		{
+			header: "from: Old Name\r\n <old@example.com>\r\nSubject: s\r\nFROM: second@example.com\r\n",
+			want:   "From: relay@example.com\r\nSubject: s\r\n",
+		},
+		{
+			header: "Subject: s\r\n",
+			want:   "Subject: s\r\nFrom: relay@example.com\r\n",
+		},
+		{
+			header: "From-Name: keep\r\n",
+			want:   "From-Name: keep\r\nFrom: relay@example.com\r\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := SetHeader(tt.header, "From", "relay@example.com"); got != tt.want {
+			t.Errorf("SetHeader(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
+// 访问控制相关状态码
+const (
+	statusAccessDenied = "554 5.7.1 Access denied"
+)
+
+// 拒绝连接时写入响应的超时，避免不读取数据的客户端阻塞处理连接的goroutine
+const rejectTimeout = 10 * time.Second
+
+// 从网络地址中提取IP地址，IPv4映射的IPv6地址会还原为IPv4
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.AddrPort().Addr()
+	default:
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip = ap.Addr()
+	}
+	if !ip.IsValid() {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// 判断IP地址是否属于任意一个网段
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查客户端地址是否允许连接
+//
+// 拒绝列表优先；配置了允许列表时，只有列表内的地址可以连接。
+func (s *Server) allowConnection(ip netip.Addr, ok bool) bool {
+	if !ok {
+		// 无法识别地址时，只有未配置任何访问控制才放行
+		return len(s.Config.AllowedNetworks) == 0 && len(s.Config.DeniedNetworks) == 0
+	}
+
+	if containsIP(s.Config.DeniedNetworks, ip) {
+		return false
+	}
+
+	if len(s.Config.AllowedNetworks) > 0 {
+		return containsIP(s.Config.AllowedNetworks, ip)
+	}
+	return true
+}
+
+// 判断客户端是否来自受信任网络，受信任网络无需认证即可投递
+func (s *Server) isTrusted(ip netip.Addr, ok bool) bool {
+	return ok && containsIP(s.Config.TrustedNetworks, ip)
+}
+
+// 当前会话在MAIL FROM之前是否必须完成认证
+func (s *smtpSession) authRequired() bool {
+	return s.cfg.AuthRequired && s.authUser == "" && !s.trusted
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/ivampiresp/smtp-queue/config"
+)
+
+func TestAddrIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 25}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25}, "2001:db8::1"},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 25}, "192.0.2.2"},
+	}
+	for _, tt := range tests {
+		ip, ok := addrIP(tt.addr)
+		if !ok || ip.String() != tt.want {
+			t.Errorf("addrIP(%v) = %v, %v，期望 %s", tt.addr, ip, ok, tt.want)
+		}
+	}
+
+	if _, ok := addrIP(&net.UnixAddr{Name: "/run/smtp.sock", Net: "unix"}); ok {
+		t.Error("Unix套接字地址不应解析出IP")
+	}
+}
+
+func TestAllowConnection(t *testing.T) {
+	prefixes := func(s ...string) []netip.Prefix {
+		var list []netip.Prefix
+		for _, p := range s {
+			list = append(list, netip.MustParsePrefix(p))
+		}
+		return list
+	}
+
+	tests := []struct {
+		name    string
+		allowed []netip.Prefix
+		denied  []netip.Prefix
+		ip      string
+		want    bool
+	}{
+		{"未配置访问控制", nil, nil, "192.0.2.1", true},
+		{"在允许列表内", prefixes("192.0.2.0/24"), nil, "192.0.2.1", true},
+		{"不在允许列表内", prefixes("192.0.2.0/24"), nil, "198.51.100.1", false},
+		{"在拒绝列表内", nil, prefixes("192.0.2.0/24"), "192.0.2.1", false},
+		{"拒绝列表优先", prefixes("192.0.2.0/24"), prefixes("192.0.2.128/25"), "192.0.2.200", false},
+		{"无法识别地址且未配置", nil, nil, "", true},
+		{"无法识别地址且配置了访问控制", nil, prefixes("192.0.2.0/24"), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.AllowedNetworks = tt.allowed
+			cfg.DeniedNetworks = tt.denied
+			srv := &Server{Config: cfg}
+
+			ip, err := netip.ParseAddr(tt.ip)
+			if got := srv.allowConnection(ip, err == nil); got != tt.want {
+				t.Errorf("allowConnection(%q) = %v，期望 %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeniedClientGets554(t *testing.T) {
+	cfg := testConfig()
+	cfg.DeniedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	_, addr := startTestServer(t, cfg)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	code, _, err := textproto.NewReader(bufio.NewReader(conn)).ReadResponse(554)
+	if err != nil {
+		t.Fatalf("期望554，得到 %d: %v", code, err)
+	}
+}
+
+func TestTrustedNetworkSkipsAuth(t *testing.T) {
+	cfg := testConfig()
+	cfg.AuthRequired = true
+	cfg.TrustedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	srv := newTestServer(t, cfg)
+	srv.auth = testAuthenticator(t, "alice", "secret")
+	addr := serveTestListener(t, srv, config.ListenerModeStartTLS)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// 地址相关状态码
+const (
+	statusInvalidAddress = "553 5.1.3 Invalid address"
+	statusNeedSMTPUTF8   = "553 5.6.7 Non-ASCII address requires SMTPUTF8"
+)
+
+var (
+	errInvalidAddress = errors.New("邮件地址无效")
+	errNeedSMTPUTF8   = errors.New("非ASCII地址需要SMTPUTF8")
+)
+
+// RFC 5321 规定的长度上限
+const (
+	maxLocalPartLength = 64
+	maxDomainLength    = 255
+)
+
+// 校验邮件地址（RFC 5321 Mailbox，RFC 6531 扩展了UTF-8字符）
+//
+// allowUTF8 为false时只接受ASCII地址。域名会经过IDNA校验，保证之后可以转换为A-label。
+func validateAddress(addr string, allowUTF8 bool) error {
+	if !utf8.ValidString(addr) {
+		return errInvalidAddress
+	}
+
+	if !allowUTF8 && !isASCII(addr) {
+		return errNeedSMTPUTF8
+	}
+
+	at := strings.LastIndexByte(addr, '@')
+	if at <= 0 || at == len(addr)-1 {
+		return errInvalidAddress
+	}
+	local, domain := addr[:at], addr[at+1:]
+
+	if len(local) > maxLocalPartLength || !validLocalPart(local) {
+		return errInvalidAddress
+	}
+
+	if len(domain) > maxDomainLength || !validDomain(domain) {
+		return errInvalidAddress
+	}
+
+	return nil
+}
+
+// 校验本地部分：Dot-string 或 Quoted-string
+func validLocalPart(local string) bool {
+	if strings.HasPrefix(local, `"`) {
+		return validQuotedString(local)
+	}
+
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, r := range atom {
+			if !isAtext(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 校验带引号的本地部分
+func validQuotedString(s string) bool {
+	if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+		return false
+	}
+
+	escaped := false
+	for _, r := range s[1 : len(s)-1] {
+		switch {
+		case escaped:
+			// quoted-pair 只能转义可打印字符
+			if r < ' ' || r == 0x7f {
+				return false
+			}
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			return false
+		case r < ' ' || r == 0x7f:
+			return false
+		}
+	}
+	return !escaped
+}
+
+// 校验域名或地址字面量
+func validDomain(domain string) bool {
+	// 地址字面量，例如 [192.0.2.1]
+	if strings.HasPrefix(domain, "[") {
+		return strings.HasSuffix(domain, "]") && len(domain) > 2
+	}
+
+	if _, err := idna.Lookup.ToASCII(domain); err != nil {
+		return false
+	}
+	return true
+}
+
+// RFC 5322 atext，以及 RFC 6531 允许的非ASCII字符
+func isAtext(r rune) bool {
+	switch {
+	case r >= utf8.RuneSelf:
+		return true
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+// 判断字符串是否只包含ASCII字符
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// 将地址校验错误转换为SMTP响应
+func addressStatus(err error) string {
+	if errors.Is(err, errNeedSMTPUTF8) {
+		return statusNeedSMTPUTF8
+	}
+	return statusInvalidAddress
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateAddress(t *testing.T) {
+	tests := []struct {
+		addr      string
+		allowUTF8 bool
+		want      error
+	}{
+		{"user@example.com", false, nil},
+		{"first.last+tag@sub.example.com", false, nil},
+		{`"john doe"@example.com`, false, nil},
+		{`"a\"b"@example.com`, false, nil},
+		{"user@[192.0.2.1]", false, nil},
+		{"用户@例子.测试", true, nil},
+		{"user@bücher.example", true, nil},
+		{"用户@example.com", false, errNeedSMTPUTF8},
+		{"user@例子.测试", false, errNeedSMTPUTF8},
+		{"user", false, errInvalidAddress},
+		{"@example.com", false, errInvalidAddress},
+		{"user@", false, errInvalidAddress},
+		{"user..name@example.com", false, errInvalidAddress},
+		{".user@example.com", false, errInvalidAddress},
+		{"us er@example.com", false, errInvalidAddress},
+		{`"unterminated@example.com`, false, errInvalidAddress},
+		{"user@[]", false, errInvalidAddress},
+		{"user@exa mple.com", false, errInvalidAddress},
+		{"\xff@example.com", true, errInvalidAddress},
+		{strings.Repeat("a", 65) + "@example.com", false, errInvalidAddress},
+	}
+	for _, tt := range tests {
+		err := validateAddress(tt.addr, tt.allowUTF8)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("validateAddress(%q, %v) = %v，期望 %v", tt.addr, tt.allowUTF8, err, tt.want)
+		}
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	_, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(553, "MAIL FROM:<用户@例子.测试>")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(553, "RCPT TO:<收件人@例子.测试>")
+	c.cmd(250, "RSET")
+
+	c.cmd(501, "MAIL FROM:<用户@例子.测试> SMTPUTF8=yes")
+	c.cmd(250, "MAIL FROM:<用户@例子.测试> SMTPUTF8")
+	c.cmd(250, "RCPT TO:<收件人@例子.测试>")
+}
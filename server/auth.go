@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 认证相关状态码
+const (
+	statusAuthOK           = "235 2.7.0 Authentication successful"
+	statusAuthFailed       = "535 5.7.8 Authentication credentials invalid"
+	statusAuthRequired     = "530 5.7.0 Authentication required"
+	statusAuthAborted      = "501 5.0.0 Authentication aborted"
+	statusAuthBadEncoding  = "501 5.5.2 Cannot decode response"
+	statusAuthUnknownMech  = "504 5.5.4 Unrecognized authentication type"
+	statusAuthAlreadyDone  = "503 5.5.1 Already authenticated"
+	statusAuthTLSRequired  = "538 5.7.11 Encryption required for requested authentication mechanism"
+	statusAuthTempFailure  = "454 4.7.0 Temporary authentication failure"
+	statusAuthNotAvailable = "503 5.5.1 Authentication not enabled"
+	statusAuthTooMany      = "421 4.7.0 Too many authentication failures, closing connection"
+)
+
+// 支持的SASL认证机制
+//
+// 凭据以bcrypt哈希保存，服务器无法取得明文密码，因此不支持CRAM-MD5等挑战-响应机制。
+var authMechanisms = []string{"PLAIN", "LOGIN"}
+
+// Authenticator 校验客户端提交的用户名和密码
+type Authenticator interface {
+	Authenticate(username, password string) (bool, error)
+}
+
+// fileAuthenticator 从htpasswd格式的文件加载bcrypt凭据
+type fileAuthenticator struct {
+	users map[string][]byte
+}
+
+// 加载凭据文件，每行格式为 "用户名:bcrypt哈希"，以#开头的行为注释
+func loadCredentialsFile(path string) (*fileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开凭据文件时出错: %w", err)
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" || hash == "" {
+			return nil, fmt.Errorf("凭据文件第%d行格式无效", lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("凭据文件第%d行不是有效的bcrypt哈希: %w", lineNo, err)
+		}
+
+		users[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取凭据文件时出错: %w", err)
+	}
+
+	return &fileAuthenticator{users: users}, nil
+}
+
+// Authenticate 校验用户名和密码
+func (a *fileAuthenticator) Authenticate(username, password string) (bool, error) {
+	hash, ok := a.users[username]
+	if !ok {
+		return false, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 当前会话是否可以进行认证
+//
+// 为避免密码以明文传输，只有加密的连接和Unix套接字上的本机客户端可以认证，
+// 除非配置了ALLOW_INSECURE_AUTH。
+func (s *smtpSession) authAvailable() bool {
+	if s.auth == nil {
+		return false
+	}
+	return s.tlsState != nil || s.local || s.cfg.AllowInsecureAuth
+}
+
+// 处理AUTH命令（RFC 4954）
+func (s *smtpSession) handleAuth(args string) error {
+	if s.auth == nil {
+		s.send(statusAuthNotAvailable)
+		return nil
+	}
+
+	if !s.esmtp {
+		s.send(statusBadSequence)
+		return nil
+	}
+
+	if s.authUser != "" {
+		s.send(statusAuthAlreadyDone)
+		return nil
+	}
+
+	// 邮件事务进行中不允许认证
+	if s.inTransaction {
+		s.send(statusBadSequence)
+		return nil
+	}
+
+	if !s.authAvailable() {
+		s.send(statusAuthTLSRequired)
+		return nil
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		s.send(statusSyntaxError)
+		return nil
+	}
+
+	mechanism := strings.ToUpper(fields[0])
+	initial := ""
+	if len(fields) == 2 {
+		initial = fields[1]
+	}
+
+	var (
+		username string
+		password string
+		err      error
+	)
+	switch mechanism {
+	case "PLAIN":
+		username, password, err = s.authPlain(initial)
+	case "LOGIN":
+		username, password, err = s.authLogin(initial)
+	default:
+		s.send(statusAuthUnknownMech)
+		return nil
+	}
+	if err != nil {
+		if errors.Is(err, errAuthAborted) {
+			s.send(statusAuthAborted)
+			return nil
+		}
+		if errors.Is(err, errAuthBadEncoding) {
+			s.send(statusAuthBadEncoding)
+			return nil
+		}
+		return err
+	}
+
+	// 认证身份会随邮件保存并写入日志，包含控制字符的用户名不可能是有效用户
+	if strings.ContainsFunc(username, unicode.IsControl) {
+		s.authFailures++
+		log.Warn().Str("client", s.conn.RemoteAddr().String()).Str("mechanism", mechanism).Int("failures", s.authFailures).Msg("客户端认证失败: 用户名包含控制字符")
+		s.authFailed()
+		return nil
+	}
+
+	ok, err := s.auth.Authenticate(username, password)
+	if err != nil {
+		log.Error().Err(err).Str("username", username).Msg("校验凭据时出错")
+		s.send(statusAuthTempFailure)
+		return nil
+	}
+	if !ok {
+		s.authFailures++
+		log.Warn().
+			Str("client", s.conn.RemoteAddr().String()).
+			Str("username", username).
+			Str("mechanism", mechanism).
+			Int("failures", s.authFailures).
+			Msg("客户端认证失败")
+		s.authFailed()
+		return nil
+	}
+
+	s.authUser = username
+	log.Info().
+		Str("client", s.conn.RemoteAddr().String()).
+		Str("username", username).
+		Str("mechanism", mechanism).
+		Msg("客户端认证成功")
+	s.send(statusAuthOK)
+	return nil
+}
+
+// 回复认证失败，失败次数达到MAX_AUTH_FAILURES时断开连接，限制对密码的猜测
+func (s *smtpSession) authFailed() {
+	if s.cfg.MaxAuthFailures > 0 && s.authFailures >= s.cfg.MaxAuthFailures {
+		log.Warn().Str("client", s.conn.RemoteAddr().String()).Int("failures", s.authFailures).Msg("认证失败次数过多，断开连接")
+		s.send(statusAuthTooMany)
+		s.quit = true
+		return
+	}
+	s.send(statusAuthFailed)
+}
+
+var (
+	errAuthAborted     = errors.New("客户端取消认证")
+	errAuthBadEncoding = errors.New("无法解码认证响应")
+)
+
+// AUTH PLAIN：响应为 authzid\0authcid\0passwd 的base64编码
+func (s *smtpSession) authPlain(initial string) (string, string, error) {
+	response := initial
+	if response == "" {
+		var err error
+		response, err = s.authChallenge("")
+		if err != nil {
+			return "", "", err
+		}
+	} else if response == "=" {
+		// "=" 表示空的初始响应
+		response = ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", "", errAuthBadEncoding
+	}
+
+	parts := bytes.Split(decoded, []byte{0})
+	if len(parts) != 3 {
+		return "", "", errAuthBadEncoding
+	}
+
+	// 不支持以其他身份代理授权
+	authzid, username := string(parts[0]), string(parts[1])
+	if authzid != "" && authzid != username {
+		return "", "", errAuthBadEncoding
+	}
+
+	return username, string(parts[2]), nil
+}
+
+// AUTH LOGIN：依次询问用户名和密码
+func (s *smtpSession) authLogin(initial string) (string, string, error) {
+	var (
+		raw string
+		err error
+	)
+
+	if initial != "" {
+		raw = initial
+	} else if raw, err = s.authChallenge("Username:"); err != nil {
+		return "", "", err
+	}
+
+	username, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return "", "", errAuthBadEncoding
+	}
+
+	if raw, err = s.authChallenge("Password:"); err != nil {
+		return "", "", err
+	}
+
+	password, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return "", "", errAuthBadEncoding
+	}
+
+	return string(username), string(password), nil
+}
+
+// 发送334挑战并读取客户端的响应行
+func (s *smtpSession) authChallenge(prompt string) (string, error) {
+	s.send("334 " + base64.StdEncoding.EncodeToString([]byte(prompt)))
+
+	line, err := s.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	line = strings.TrimSpace(line)
+	if line == "*" {
+		return "", errAuthAborted
+	}
+	return line, nil
+}
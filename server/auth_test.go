@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ivampiresp/smtp-queue/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 生成只包含一个用户的测试凭据
+func testAuthenticator(t *testing.T, username, password string) *fileAuthenticator {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	content := "# 测试用户\n\n" + username + ":" + string(hash) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := loadCredentialsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestLoadCredentialsFileRejectsInvalidLines(t *testing.T) {
+	for _, content := range []string{
+		"alice\n",
+		"alice:\n",
+		"alice:plaintext\n",
+	} {
+		path := filepath.Join(t.TempDir(), "users")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadCredentialsFile(path); err == nil {
+			t.Errorf("凭据文件 %q 应当加载失败", content)
+		}
+	}
+}
+
+func TestAuthPlain(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowInsecureAuth = true
+	srv := newTestServer(t, cfg)
+	srv.auth = testAuthenticator(t, "alice", "secret")
+	addr := serveTestListener(t, srv, config.ListenerModeStartTLS)
+	c := dialTestServer(t, addr)
+
+	c.cmd(503, "AUTH PLAIN %s", b64("\x00alice\x00secret"))
+	if !strings.Contains(c.cmd(250, "EHLO client.test"), "\nAUTH PLAIN LOGIN") {
+		t.Fatal("未通告AUTH")
+	}
+	c.cmd(504, "AUTH CRAM-MD5")
+	c.cmd(501, "AUTH PLAIN not-base64")
+	c.cmd(501, "AUTH PLAIN %s", b64("bob\x00alice\x00secret"))
+	c.cmd(535, "AUTH PLAIN %s", b64("\x00alice\x00wrong"))
+	c.cmd(535, "AUTH PLAIN %s", b64("\x00mallory\x00secret"))
+	c.cmd(535, "AUTH PLAIN %s", b64("\x00alice\r\nX-Injected: 1\x00secret"))
+
+	// 不带初始响应时通过334挑战获取
+	c.cmd(334, "AUTH PLAIN")
+	c.cmd(235, "%s", b64("alice\x00alice\x00secret"))
+	c.cmd(503, "AUTH PLAIN %s", b64("\x00alice\x00secret"))
+}
+
+func TestAuthLogin(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowInsecureAuth = true
+	srv := newTestServer(t, cfg)
+	srv.auth = testAuthenticator(t, "alice", "secret")
+	addr := serveTestListener(t, srv, config.ListenerModeStartTLS)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	if msg := c.cmd(334, "AUTH LOGIN"); msg != b64("Username:") {
+		t.Errorf("用户名挑战 = %q", msg)
+	}
+	c.cmd(501, "*")
+
+	c.cmd(334, "AUTH LOGIN %s", b64("alice"))
+	c.cmd(235, "%s", b64("secret"))
+}
+
+func TestAuthRequiresTLSWhenAvailable(t *testing.T) {
+	srv := newTestServer(t, testConfig())
+	srv.auth = testAuthenticator(t, "alice", "secret")
+	srv.tlsConfig = testTLSConfig(t)
+	addr := serveTestListener(t, srv, config.ListenerModeStartTLS)
+	c := dialTestServer(t, addr)
+
+	if strings.Contains(c.cmd(250, "EHLO client.test"), "AUTH") {
+		t.Error("STARTTLS之前通告了AUTH")
+	}
+	c.cmd(538, "AUTH PLAIN %s", b64("\x00alice\x00secret"))
+
+	c.cmd(220, "STARTTLS")
+	c.handshake()
+	if !strings.Contains(c.cmd(250, "EHLO client.test"), "\nAUTH PLAIN LOGIN") {
+		t.Error("STARTTLS之后未通告AUTH")
+	}
+	c.cmd(235, "AUTH PLAIN %s", b64("\x00alice\x00secret"))
+}
+
+func TestAuthRequiresEncryption(t *testing.T) {
+	srv := newTestServer(t, testConfig())
+	srv.auth = testAuthenticator(t, "alice", "secret")
+	addr := serveTestListener(t, srv, config.ListenerModePlain)
+	c := dialTestServer(t, addr)
+
+	// 无法加密的明文连接上不提供认证
+	if strings.Contains(c.cmd(250, "EHLO client.test"), "AUTH") {
+		t.Error("明文连接上通告了AUTH")
+	}
+	c.cmd(538, "AUTH PLAIN %s", b64("\x00alice\x00secret"))
+}
+
+func TestAuthOnUnixSocket(t *testing.T) {
+	srv := newTestServer(t, testConfig())
+	srv.auth = testAuthenticator(t, "alice", "secret")
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+	serveListenerConfig(t, srv, config.ListenerConfig{Addr: "unix:" + path, Mode: config.ListenerModePlain})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, conn)
+
+	// 本机客户端的凭据不经过网络，无需加密
+	if !strings.Contains(c.cmd(250, "EHLO client.test"), "\nAUTH PLAIN LOGIN") {
+		t.Error("Unix套接字上未通告AUTH")
+	}
+	c.cmd(235, "AUTH PLAIN %s", b64("\x00alice\x00secret"))
+}
+
+func TestAuthFailureLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowInsecureAuth = true
+	cfg.MaxAuthFailures = 2
+	srv := newTestServer(t, cfg)
+	srv.auth = testAuthenticator(t, "alice", "secret")
+	addr := serveTestListener(t, srv, config.ListenerModeStartTLS)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(535, "AUTH PLAIN %s", b64("\x00alice\x00wrong"))
+	// RSET不清除失败次数
+	c.cmd(250, "RSET")
+	c.cmd(421, "AUTH PLAIN %s", b64("\x00alice\x00guess"))
+
+	if _, err := c.ReadLine(); err == nil {
+		t.Error("认证失败次数过多后连接未关闭")
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	cfg := testConfig()
+	cfg.AuthRequired = true
+	cfg.AllowInsecureAuth = true
+	srv := newTestServer(t, cfg)
+	srv.auth = testAuthenticator(t, "alice", "secret")
+	addr := serveTestListener(t, srv, config.ListenerModeStartTLS)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(530, "MAIL FROM:<sender@client.test>")
+	c.cmd(235, "AUTH PLAIN %s", b64("\x00alice\x00secret"))
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+
+	// 事务进行中不允许认证
+	c.cmd(503, "AUTH PLAIN %s", b64("\x00alice\x00secret"))
+}
+
+func TestAuthNotConfigured(t *testing.T) {
+	_, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	if strings.Contains(c.cmd(250, "EHLO client.test"), "AUTH") {
+		t.Error("未配置凭据时通告了AUTH")
+	}
+	c.cmd(503, "AUTH PLAIN %s", b64("\x00alice\x00secret"))
+}
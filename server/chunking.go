@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CHUNKING 相关状态码
+const (
+	statusBinaryMIMENeedsBDAT = "503 5.5.1 BODY=BINARYMIME requires BDAT"
+	statusDataAfterBDAT       = "503 5.5.1 DATA not allowed after BDAT"
+)
+
+// 处理BDAT命令（RFC 3030）
+//
+// 无论命令是否被接受，都必须读取客户端随命令发送的数据块，
+// 否则后续的数据会被当作命令解析，会话将失去同步。
+func (s *smtpSession) handleBdat(args string) error {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		s.send(statusSyntaxError)
+		return nil
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		// 无法确定数据块大小，会话已无法同步
+		s.send(statusSyntaxError)
+		return errors.New("BDAT 数据块大小无效")
+	}
+
+	last := false
+	if len(fields) == 2 {
+		if !strings.EqualFold(fields[1], "LAST") {
+			s.send(statusSyntaxError)
+			return s.discardChunk(size)
+		}
+		last = true
+	}
+
+	if !s.esmtp || len(s.rcptTo) == 0 {
+		if err := s.discardChunk(size); err != nil {
+			return err
+		}
+		s.send(statusBadSequence)
+		return nil
+	}
+
+	// 首个数据块到达时创建临时文件
+	if s.chunks == nil {
+		s.chunks, err = newDataSpool()
+		if err != nil {
+			log.Error().Err(err).Msg("创建临时文件时出错")
+			if err := s.discardChunk(size); err != nil {
+				return err
+			}
+			s.send(statusLocalError)
+			return nil
+		}
+	}
+
+	// 超过大小限制时丢弃整个事务
+	if s.cfg.MaxMessageSize > 0 && s.chunks.size+size > s.cfg.MaxMessageSize {
+		if err := s.discardChunk(size); err != nil {
+			return err
+		}
+		log.Warn().Int64("max_size", s.cfg.MaxMessageSize).Msg("邮件超过大小限制，已拒绝")
+		// LMTP中BDAT LAST与DATA结束一样，为每个收件人回复，必须在重置事务之前发送
+		if last {
+			s.replyMessage(statusMessageTooLarge)
+		} else {
+			s.send(statusMessageTooLarge)
+		}
+		s.reset()
+		return nil
+	}
+
+	if _, err := io.CopyN(s.chunks, dataBlockReader{s}, size); err != nil {
+		return err
+	}
+
+	if !last {
+		s.send(fmt.Sprintf("250 2.0.0 %d octets received", size))
+		return nil
+	}
+
+	s.completeMessage(s.chunks)
+	return nil
+}
+
+// 读取并丢弃一个数据块
+func (s *smtpSession) discardChunk(size int64) error {
+	_, err := io.CopyN(io.Discard, dataBlockReader{s}, size)
+	return err
+}
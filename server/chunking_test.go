@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ivampiresp/smtp-queue/config"
+)
+
+// 发送一个BDAT数据块并检查响应码
+func (c *testClient) bdat(code int, chunk string, last bool) string {
+	c.t.Helper()
+
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	if _, err := c.conn.Write([]byte(cmd + "\r\n" + chunk)); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(code)
+}
+
+func TestBdat(t *testing.T) {
+	srv, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+
+	// 事务开始之前的数据块同样要被读取，会话保持同步
+	c.bdat(503, "RCPT TO:<injected@example.test>\r\n", true)
+
+	c.cmd(250, "MAIL FROM:<sender@client.test> BODY=BINARYMIME")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.cmd(503, "DATA")
+
+	// 二进制内容：裸LF、NUL以及以点开头的行都必须原样保存
+	first := "Subject: binary\r\n\r\n"
+	second := ".line\n\x00\xff\r\n"
+	c.bdat(250, first, false)
+	c.cmd(503, "DATA")
+	c.bdat(250, second, true)
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("队列中有%d封邮件，期望1封", len(emails))
+	}
+	if emails[0].BodyType != "BINARYMIME" {
+		t.Errorf("BodyType = %q", emails[0].BodyType)
+	}
+	if !strings.Contains(emails[0].Body, "Subject: binary\r\n") || !strings.HasSuffix(emails[0].Body, "\r\n\r\n"+second) {
+		t.Errorf("邮件内容 = %q", emails[0].Body)
+	}
+
+	// 无效的数据块大小无法恢复同步，服务器断开连接
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.cmd(501, "BDAT abc")
+	if _, err := c.ReadLine(); err == nil {
+		t.Error("BDAT大小无效后连接应当关闭")
+	}
+}
+
+func TestBdatSizeLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 10
+	_, addr := startTestServer(t, cfg)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.bdat(250, "12345", false)
+	c.bdat(552, "678901", true)
+
+	// 超限后事务被丢弃
+	c.cmd(503, "RCPT TO:<rcpt@example.test>")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+}
+
+func TestBinaryMIMERequiresBdat(t *testing.T) {
+	_, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test> BODY=BINARYMIME")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.cmd(503, "DATA")
+}
+
+func TestLMTPBdatSizeLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 100
+	srv := newTestServer(t, cfg)
+	c := dialTestServer(t, serveTestListener(t, srv, config.ListenerModeLMTP))
+
+	c.cmd(250, "LHLO client.test")
+
+	// BDAT LAST超过大小限制时为每个收件人回复552
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<one@example.test>")
+	c.cmd(250, "RCPT TO:<two@example.test>")
+	c.bdat(552, "Subject: big\r\n\r\n"+strings.Repeat("x", 200)+"\r\n", true)
+	c.expect(552)
+	c.cmd(250, "NOOP")
+
+	// 中间的数据块超过限制时只回复一次，事务已被丢弃
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<one@example.test>")
+	c.cmd(250, "RCPT TO:<two@example.test>")
+	c.bdat(552, strings.Repeat("x", 200), false)
+	c.bdat(503, "tail\r\n", true)
+	c.cmd(250, "NOOP")
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 0 {
+		t.Fatalf("队列中有%d封邮件，期望0封", len(emails))
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 邮件内容相关状态码
+const (
+	statusMessageTooLarge = "552 5.3.4 Message size exceeds fixed maximum message size"
+	statusLocalError      = "451 4.3.0 Requested action aborted: local error in processing"
+	statusLineTooLong     = "500 5.5.2 Line too long"
+)
+
+// 命令行的最大长度，RFC 5321 要求至少支持512字节，这里留出ESMTP参数的余量
+const maxCommandLineLength = 4096
+
+var (
+	errLineTooLong     = errors.New("命令行过长")
+	errMessageTooLarge = errors.New("邮件超过大小限制")
+)
+
+// dataSpool 将接收中的邮件内容写入临时文件，避免整封邮件驻留内存
+type dataSpool struct {
+	f    *os.File
+	size int64
+}
+
+// 创建新的临时文件
+func newDataSpool() (*dataSpool, error) {
+	f, err := os.CreateTemp("", "smtp-queue-data-*")
+	if err != nil {
+		return nil, err
+	}
+	return &dataSpool{f: f}, nil
+}
+
+// Write 追加邮件内容
+func (d *dataSpool) Write(p []byte) (int, error) {
+	n, err := d.f.Write(p)
+	d.size += int64(n)
+	return n, err
+}
+
+// Reader 返回从头读取已写入内容的Reader
+func (d *dataSpool) Reader() (io.Reader, error) {
+	if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return d.f, nil
+}
+
+// Close 关闭并删除临时文件
+func (d *dataSpool) Close() error {
+	err := d.f.Close()
+	if removeErr := os.Remove(d.f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// 读取一行命令，去掉行尾的CRLF
+//
+// 超过长度限制的行会被完整读取并丢弃，返回errLineTooLong，会话可以继续。
+func (s *smtpSession) readLine() (string, error) {
+	var (
+		line    []byte
+		tooLong bool
+	)
+	for {
+		if err := s.flushIfIdle(); err != nil {
+			return "", err
+		}
+		s.awaitCommand()
+
+		chunk, err := s.reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(line) > maxCommandLineLength {
+				tooLong = true
+				line = nil
+			}
+		}
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
+
+// 读取DATA内容直到结束标记"."，去除透明点后写入w
+//
+// 超过maxSize（大于0时生效）后不再写入，但仍会读取到结束标记以保持会话同步，
+// 最后返回errMessageTooLarge。
+func (s *smtpSession) readData(w io.Writer, maxSize int64) error {
+	var (
+		size        int64
+		tooLarge    bool
+		atLineStart = true
+	)
+	for {
+		if err := s.flushIfIdle(); err != nil {
+			return err
+		}
+		s.awaitDataBlock()
+
+		chunk, err := s.reader.ReadSlice('\n')
+		partial := errors.Is(err, bufio.ErrBufferFull)
+		if err != nil && !partial {
+			return err
+		}
+
+		if atLineStart && !partial {
+			// 数据结束标记
+			if bytes.Equal(chunk, []byte(".\r\n")) || bytes.Equal(chunk, []byte(".\n")) {
+				break
+			}
+		}
+
+		// 处理行首的点
+		if atLineStart && len(chunk) > 0 && chunk[0] == '.' {
+			chunk = chunk[1:]
+		}
+		atLineStart = !partial
+
+		size += int64(len(chunk))
+		if maxSize > 0 && size > maxSize {
+			tooLarge = true
+		}
+		if tooLarge {
+			continue
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	if tooLarge {
+		return errMessageTooLarge
+	}
+	return nil
+}
+
+// 邮件内容接收完毕后将其加入队列并回复客户端，最后重置邮件事务
+func (s *smtpSession) completeMessage(spool *dataSpool) {
+	defer s.reset()
+
+	s.awaitDataTermination()
+
+	// 处理邮件
+	queueID, err := s.processEmail(spool)
+	if err != nil {
+		log.Error().Err(err).Msg("处理邮件时出错")
+		s.replyMessage(fmt.Sprintf("554 5.3.0 Transaction failed: %s", err.Error()))
+		return
+	}
+
+	// 回复队列标识，客户端可以据此将自己的发送记录与队列中的邮件对应起来
+	s.replyMessage(fmt.Sprintf("250 2.0.0 Ok: queued as %s", queueID))
+}
+
+// 回复邮件内容阶段的结果
+//
+// LMTP 要求为每个收件人分别回复（RFC 2033 4.2）。邮件只入队一次，所有收件人的结果相同。
+func (s *smtpSession) replyMessage(reply string) {
+	if !s.lmtp {
+		s.send(reply)
+		return
+	}
+	for range s.rcptTo {
+		s.send(reply)
+	}
+}
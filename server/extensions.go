@@ -0,0 +1,87 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+// extension 描述一个在EHLO响应中通告的ESMTP扩展
+type extension struct {
+	// 扩展关键字，例如 8BITMIME
+	name string
+
+	// params 返回扩展关键字后附带的参数，为nil时仅通告关键字
+	params func(s *smtpSession) string
+
+	// enabled 判断当前会话是否通告该扩展，为nil时始终通告
+	enabled func(s *smtpSession) bool
+}
+
+// 服务器支持的ESMTP扩展，按通告顺序排列
+//
+// 只有会话状态机确实实现了的扩展才应登记在这里，
+// 客户端会根据EHLO响应决定使用哪些特性。
+var extensions = []extension{
+	{
+		name: "SIZE",
+		params: func(s *smtpSession) string {
+			// SIZE 0 表示没有固定的大小限制
+			return strconv.FormatInt(s.cfg.MaxMessageSize, 10)
+		},
+	},
+	{
+		name: "PIPELINING",
+	},
+	{
+		name: "8BITMIME",
+	},
+	{
+		name: "ENHANCEDSTATUSCODES",
+	},
+	{
+		name: "CHUNKING",
+	},
+	{
+		name: "BINARYMIME",
+	},
+	{
+		name: "SMTPUTF8",
+	},
+	{
+		name: "DSN",
+	},
+	{
+		name: "STARTTLS",
+		enabled: func(s *smtpSession) bool {
+			return s.tlsConfig != nil && s.tlsState == nil
+		},
+	},
+	{
+		name: "AUTH",
+		params: func(s *smtpSession) string {
+			return strings.Join(authMechanisms, " ")
+		},
+		enabled: func(s *smtpSession) bool {
+			return s.authAvailable()
+		},
+	},
+}
+
+// capabilities 返回当前会话在EHLO响应中通告的扩展列表
+func (s *smtpSession) capabilities() []string {
+	var caps []string
+	for _, ext := range extensions {
+		if ext.enabled != nil && !ext.enabled(s) {
+			continue
+		}
+
+		line := ext.name
+		if ext.params != nil {
+			if params := ext.params(s); params != "" {
+				line += " " + params
+			}
+		}
+		caps = append(caps, line)
+	}
+	return caps
+}
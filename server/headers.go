@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ivampiresp/smtp-queue/message"
+)
+
+// 生成入队的邮件内容：在邮件开头加入Received追踪头，并为缺少Message-ID或Date的邮件补充这两个头
+//
+// Received头按RFC 5321 4.4的格式记录客户端的HELO名称、IP地址、TLS信息和队列标识，
+// 补充的头加在邮件头部分的末尾。邮件内容从r中流式读取，size为其长度，
+// 只在内存中保留生成的邮件内容这一份副本。队列存储以字符串保存邮件，
+// 因此整封邮件仍会读入内存，占用的内存受MAX_MESSAGE_SIZE限制。同时返回原始的头部分。
+func (s *smtpSession) buildContent(r io.Reader, size int64, queueID string) (content, header string, err error) {
+	now := time.Now()
+
+	reader := bufio.NewReader(r)
+	header, next, err := message.ReadHeader(reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	received := s.receivedHeader(queueID, now)
+
+	var b strings.Builder
+	// 额外的空间用于补充的头和分隔空行
+	b.Grow(len(received) + int(size) + 256)
+	b.WriteString(received)
+	b.WriteString(header)
+	if !message.HasHeader(header, "Message-ID") {
+		fmt.Fprintf(&b, "Message-ID: <%s.%s@%s>\r\n", now.Format("20060102150405"), queueID, s.cfg.Hostname)
+	}
+	if !message.HasHeader(header, "Date") {
+		fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+	b.WriteString(next)
+	if _, err := io.Copy(&b, reader); err != nil {
+		return "", "", err
+	}
+	return b.String(), header, nil
+}
+
+// 生成Received头，例如：
+//
+//	Received: from client.example ([192.0.2.1])
+//		by mx.example (SMTP Queue) with ESMTPS id 1A2B3C4D5E6F7081
+//		(version=TLS 1.3 cipher=TLS_AES_128_GCM_SHA256)
+//		for <user@example.com>; Mon, 02 Jan 2006 15:04:05 -0700
+func (s *smtpSession) receivedHeader(queueID string, now time.Time) string {
+	var b strings.Builder
+
+	helo := headerText(s.helo)
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	client := "localhost"
+	if ip, ok := addrIP(s.conn.RemoteAddr()); ok {
+		client = "[" + ip.String() + "]"
+		if ip.Is6() {
+			client = "[IPv6:" + ip.String() + "]"
+		}
+	}
+
+	fmt.Fprintf(&b, "Received: from %s (%s)\r\n", helo, client)
+	fmt.Fprintf(&b, "\tby %s (SMTP Queue) with %s id %s", s.cfg.Hostname, s.protocol(), queueID)
+
+	if s.tlsState != nil {
+		fmt.Fprintf(&b, "\r\n\t(version=%s cipher=%s)", tls.VersionName(s.tlsState.Version), tls.CipherSuiteName(s.tlsState.CipherSuite))
+	}
+
+	// 只有一个收件人时才记录，避免泄露其他收件人
+	if len(s.rcptTo) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", s.rcptTo[0])
+	}
+
+	fmt.Fprintf(&b, "; %s\r\n", now.Format(time.RFC1123Z))
+	return b.String()
+}
+
+// 清理写入邮件头的客户端文本：控制字符（包括CR和LF）替换为空格并合并连续空白，
+// 避免客户端通过HELO等参数注入额外的邮件头
+func headerText(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// 传输协议名称（RFC 3848、RFC 6531），例如ESMTPSA表示加密且已认证的ESMTP
+func (s *smtpSession) protocol() string {
+	var name string
+	switch {
+	case s.lmtp:
+		name = "LMTP"
+	case s.esmtp:
+		name = "ESMTP"
+	default:
+		return "SMTP"
+	}
+
+	if s.smtputf8 {
+		name = "UTF8" + strings.TrimPrefix(name, "E")
+	}
+	if s.tlsState != nil {
+		name += "S"
+	}
+	if s.authUser != "" {
+		name += "A"
+	}
+	return name
+}
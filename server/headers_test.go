@@ -0,0 +1,125 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ivampiresp/smtp-queue/message"
+)
+
+func TestTraceHeaders(t *testing.T) {
+	srv, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.data(250, "Subject: one\r\n\r\nbody\r\n")
+
+	// 已有的Message-ID和Date保持不变，多个收件人时不记录for子句
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<one@example.test>")
+	c.cmd(250, "RCPT TO:<two@example.test>")
+	c.data(250, "Message-ID: <kept@client.test>\r\nDate: Mon, 02 Jan 2006 15:04:05 -0700\r\n\r\nbody\r\n")
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 2 {
+		t.Fatalf("队列中有%d封邮件，期望2封", len(emails))
+	}
+
+	first := emails[0].Body
+	if !strings.HasPrefix(first, "Received: from client.test ([127.0.0.1])\r\n\tby mx.test (SMTP Queue) with ESMTP id ") {
+		t.Errorf("Received头 = %q", first)
+	}
+	if !strings.Contains(first, "\r\n\tfor <rcpt@example.test>; ") {
+		t.Errorf("单个收件人时应记录for子句: %q", first)
+	}
+	header, _ := message.SplitHeader(first)
+	if !message.HasHeader(header, "Message-ID") || !message.HasHeader(header, "Date") {
+		t.Errorf("未补充Message-ID或Date: %q", header)
+	}
+	if !strings.HasSuffix(first, "\r\n\r\nbody\r\n") {
+		t.Errorf("邮件正文 = %q", first)
+	}
+
+	second := emails[1].Body
+	if strings.Contains(second, "\tfor <") {
+		t.Errorf("多个收件人时不应记录for子句: %q", second)
+	}
+	if strings.Count(second, "Message-ID:") != 1 || strings.Count(second, "Date:") != 1 {
+		t.Errorf("重复添加了Message-ID或Date: %q", second)
+	}
+}
+
+func TestHeaderText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"client.test", "client.test"},
+		{"client.test\r\nX-Injected: 1", "client.test X-Injected: 1"},
+		{"a\x00b\tc  d\x7f", "a b c d"},
+		{"\r\n", ""},
+	}
+	for _, tt := range tests {
+		if got := headerText(tt.in); got != tt.want {
+			t.Errorf("headerText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHELOWithControlCharacters(t *testing.T) {
+	_, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(501, "EHLO client.test\rX-Injected: 1")
+	c.cmd(501, "HELO client\x00test")
+	c.cmd(503, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "EHLO client.test")
+}
+
+func TestProtocolName(t *testing.T) {
+	tests := []struct {
+		session smtpSession
+		want    string
+	}{
+		{smtpSession{}, "SMTP"},
+		{smtpSession{esmtp: true}, "ESMTP"},
+		{smtpSession{esmtp: true, authUser: "alice"}, "ESMTPA"},
+		{smtpSession{esmtp: true, smtputf8: true}, "UTF8SMTP"},
+		{smtpSession{lmtp: true, esmtp: true}, "LMTP"},
+	}
+	for _, tt := range tests {
+		if got := tt.session.protocol(); got != tt.want {
+			t.Errorf("protocol() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestQueueIDReply(t *testing.T) {
+	srv, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	msg := c.data(250, "Subject: id\r\n\r\nbody\r\n")
+
+	queueID, ok := strings.CutPrefix(msg, "2.0.0 Ok: queued as ")
+	if !ok || queueID == "" {
+		t.Fatalf("DATA 响应 = %q", msg)
+	}
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].QueueID != queueID {
+		t.Fatalf("队列中的邮件 = %+v，期望队列标识 %s", emails, queueID)
+	}
+	if !strings.Contains(emails[0].Body, " id "+queueID+"\r\n") {
+		t.Errorf("Received头中缺少队列标识: %q", emails[0].Body)
+	}
+}
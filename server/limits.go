@@ -0,0 +1,217 @@
+package server
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ivampiresp/smtp-queue/config"
+	"github.com/rs/zerolog/log"
+)
+
+// 限流相关状态码
+const (
+	statusTooManyConnections = "421 4.7.0 Too many connections, try again later"
+	statusMessageRateLimit   = "451 4.7.1 Message rate limit exceeded, try again later"
+	statusRecipientRateLimit = "451 4.7.1 Recipient rate limit exceeded, try again later"
+)
+
+// 日志中limit字段的取值，标识触发拒绝的限制
+const (
+	limitConnections      = "connections"
+	limitConnectionsPerIP = "connections_per_ip"
+	limitMessageRate      = "message_rate"
+	limitRecipientRate    = "recipient_rate"
+)
+
+// 令牌桶空闲超过该时间后会在下次清理时移除
+const bucketIdleTimeout = 10 * time.Minute
+
+// tokenBucket 是单个客户端的令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter 按键（IP地址或认证用户）维护令牌桶，
+// 每分钟补充perMinute个令牌，桶容量同为perMinute
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		perMinute: perMinute,
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow 从键对应的令牌桶中取出一个令牌，令牌不足时返回false。
+// perMinute为0表示不限制
+func (l *rateLimiter) allow(key string) bool {
+	if l.perMinute <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	capacity := float64(l.perMinute)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+
+	// 按流逝的时间补充令牌
+	b.tokens += now.Sub(b.last).Minutes() * capacity
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+	b.last = now
+
+	l.prune(now)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 移除长时间未使用的令牌桶，它们在下次使用时会以满桶重新创建
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < bucketIdleTimeout {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= bucketIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// 当前跟踪的令牌桶数量
+func (l *rateLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// limits 保存服务器的连接数和投递速率限制状态
+type limits struct {
+	maxConnections      int
+	maxConnectionsPerIP int
+
+	mu          sync.Mutex
+	connections int
+	perIP       map[netip.Addr]int
+
+	messages   *rateLimiter
+	recipients *rateLimiter
+
+	// 各项限制累计拒绝的次数，随拒绝日志的rejected字段输出
+	rejected struct {
+		connections      atomic.Int64
+		connectionsPerIP atomic.Int64
+		messages         atomic.Int64
+		recipients       atomic.Int64
+	}
+}
+
+func newLimits(cfg *config.Config) *limits {
+	return &limits{
+		maxConnections:      cfg.MaxConnections,
+		maxConnectionsPerIP: cfg.MaxConnectionsPerIP,
+		perIP:               make(map[netip.Addr]int),
+		messages:            newRateLimiter(cfg.MessageRateLimit),
+		recipients:          newRateLimiter(cfg.RecipientRateLimit),
+	}
+}
+
+// acquireConnection 登记一个新连接，超过全局或单个IP的并发上限时返回false。
+// 返回true时调用方必须在连接关闭后调用releaseConnection
+func (l *limits) acquireConnection(ip netip.Addr, ok bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxConnections > 0 && l.connections >= l.maxConnections {
+		log.Warn().Str("limit", limitConnections).Str("ip", ip.String()).Int("connections", l.connections).Int("max", l.maxConnections).
+			Int64("rejected", l.rejected.connections.Add(1)).Msg("连接数已达到全局上限")
+		return false
+	}
+
+	// 无法识别地址的客户端（例如Unix域套接字）只受全局上限约束
+	if ok && l.maxConnectionsPerIP > 0 && l.perIP[ip] >= l.maxConnectionsPerIP {
+		log.Warn().Str("limit", limitConnectionsPerIP).Str("ip", ip.String()).Int("connections", l.perIP[ip]).Int("max", l.maxConnectionsPerIP).
+			Int64("rejected", l.rejected.connectionsPerIP.Add(1)).Msg("客户端连接数已达到上限")
+		return false
+	}
+
+	l.connections++
+	if ok {
+		l.perIP[ip]++
+	}
+	return true
+}
+
+// releaseConnection 注销由acquireConnection登记的连接
+func (l *limits) releaseConnection(ip netip.Addr, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.connections--
+	if ok {
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+	}
+}
+
+// 当前连接数
+func (l *limits) activeConnections() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.connections
+}
+
+// 当前会话的限流键：认证用户按用户名计数，其余客户端按IP地址计数
+func (s *smtpSession) rateLimitKey() string {
+	if s.authUser != "" {
+		return "user:" + s.authUser
+	}
+	if ip, ok := addrIP(s.conn.RemoteAddr()); ok {
+		return "ip:" + ip.String()
+	}
+	return "local"
+}
+
+// 检查当前会话是否还能开始新的邮件事务
+func (s *smtpSession) allowMessage() bool {
+	key := s.rateLimitKey()
+	if s.limits.messages.allow(key) {
+		return true
+	}
+	log.Warn().Str("limit", limitMessageRate).Str("key", key).Int("max", s.limits.messages.perMinute).Int("tracked", s.limits.messages.size()).
+		Int64("rejected", s.limits.rejected.messages.Add(1)).Msg("邮件速率超过限制")
+	return false
+}
+
+// 检查当前会话是否还能添加收件人
+func (s *smtpSession) allowRecipient() bool {
+	key := s.rateLimitKey()
+	if s.limits.recipients.allow(key) {
+		return true
+	}
+	log.Warn().Str("limit", limitRecipientRate).Str("key", key).Int("max", s.limits.recipients.perMinute).Int("tracked", s.limits.recipients.size()).
+		Int64("rejected", s.limits.rejected.recipients.Add(1)).Msg("收件人速率超过限制")
+	return false
+}
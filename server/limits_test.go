@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2)
+	if !l.allow("a") || !l.allow("a") {
+		t.Fatal("令牌桶容量内的请求被拒绝")
+	}
+	if l.allow("a") {
+		t.Error("超过容量的请求未被拒绝")
+	}
+	if !l.allow("b") {
+		t.Error("不同的键共用了令牌桶")
+	}
+
+	if unlimited := newRateLimiter(0); !unlimited.allow("a") || unlimited.size() != 0 {
+		t.Error("perMinute为0时应不限制且不跟踪令牌桶")
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxConnectionsPerIP = 1
+	srv, addr := startTestServer(t, cfg)
+
+	first := dialTestServer(t, addr)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, _, err := textproto.NewConn(conn).ReadResponse(421); err != nil {
+		t.Fatalf("超过连接数上限的连接应收到421: %v", err)
+	}
+	if got := srv.limits.rejected.connectionsPerIP.Load(); got != 1 {
+		t.Errorf("rejected.connectionsPerIP = %d, want 1", got)
+	}
+
+	// 第一个连接关闭后可以重新连接
+	first.cmd(221, "QUIT")
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.limits.activeConnections() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dialTestServer(t, addr).cmd(250, "EHLO client.test")
+}
+
+func TestRateLimitRejections(t *testing.T) {
+	cfg := testConfig()
+	cfg.MessageRateLimit = 1
+	cfg.RecipientRateLimit = 1
+	srv, addr := startTestServer(t, cfg)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<one@example.test>")
+	c.cmd(451, "RCPT TO:<two@example.test>")
+	c.cmd(250, "RSET")
+	c.cmd(451, "MAIL FROM:<sender@client.test>")
+
+	if got := srv.limits.rejected.messages.Load(); got != 1 {
+		t.Errorf("rejected.messages = %d, want 1", got)
+	}
+	if got := srv.limits.rejected.recipients.Load(); got != 1 {
+		t.Errorf("rejected.recipients = %d, want 1", got)
+	}
+}
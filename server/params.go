@@ -0,0 +1,196 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ivampiresp/smtp-queue/dsn"
+)
+
+var (
+	errPathSyntax  = errors.New("路径语法错误")
+	errParamSyntax = errors.New("ESMTP参数语法错误")
+)
+
+// pathArgs 是解析后的 MAIL FROM / RCPT TO 参数
+type pathArgs struct {
+	// 去掉尖括号和源路由的地址，空反向路径"<>"时为空
+	address string
+
+	// ESMTP参数，按出现顺序排列
+	params []esmtpParam
+}
+
+// esmtpParam 表示一个ESMTP参数（RFC 5321 4.1.2 esmtp-param）
+type esmtpParam struct {
+	key   string // 参数名，统一为大写
+	value string // 参数值，没有"="时为空
+}
+
+// String 返回参数在SMTP命令中的形式
+func (p esmtpParam) String() string {
+	if p.value == "" {
+		return p.key
+	}
+	return p.key + "=" + p.value
+}
+
+// 将参数列表格式化为SMTP命令中的形式，以空格分隔
+func joinParams(params []esmtpParam) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+// parsePathArgs 解析 "FROM:<path> 参数..." 或 "TO:<path> 参数..." 形式的命令参数
+//
+// keyword 为 FROM 或 TO。为兼容常见客户端，冒号后的空格和缺少尖括号的地址也会被接受。
+func parsePathArgs(args, keyword string) (*pathArgs, error) {
+	if len(args) <= len(keyword) ||
+		!strings.EqualFold(args[:len(keyword)], keyword) ||
+		args[len(keyword)] != ':' {
+		return nil, errPathSyntax
+	}
+
+	rest := strings.TrimLeft(args[len(keyword)+1:], " ")
+	path, rest, err := splitPath(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	address, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := parseParams(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pathArgs{address: address, params: params}, nil
+}
+
+// 从参数开头拆分出路径，返回路径和剩余部分
+//
+// 带引号的本地部分可以包含空格和">"，因此需要逐字符扫描。
+func splitPath(s string) (string, string, error) {
+	if s == "" {
+		return "", "", errPathSyntax
+	}
+
+	// 没有尖括号时路径到第一个空格为止
+	if s[0] != '<' {
+		path, rest, _ := strings.Cut(s, " ")
+		return "<" + path + ">", rest, nil
+	}
+
+	inQuote := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case inQuote && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			inQuote = !inQuote
+		case !inQuote && s[i] == '>':
+			rest := s[i+1:]
+			if rest != "" && rest[0] != ' ' {
+				return "", "", errPathSyntax
+			}
+			return s[:i+1], rest, nil
+		}
+	}
+	return "", "", errPathSyntax
+}
+
+// 解析 "<[源路由:]邮箱>" 形式的路径，返回邮箱地址
+func parsePath(path string) (string, error) {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "<"), ">")
+
+	// 源路由（A-d-l）已被RFC 5321废弃，必须接受但应忽略
+	if strings.HasPrefix(path, "@") {
+		_, mailbox, ok := strings.Cut(path, ":")
+		if !ok {
+			return "", errPathSyntax
+		}
+		path = mailbox
+	}
+
+	return normalizeAddress(path), nil
+}
+
+// 将域名部分转换为小写，本地部分保持原样（RFC 5321 规定本地部分区分大小写）
+func normalizeAddress(addr string) string {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return addr
+	}
+	return addr[:at+1] + strings.ToLower(addr[at+1:])
+}
+
+// 解析以空格分隔的ESMTP参数
+func parseParams(s string) ([]esmtpParam, error) {
+	var params []esmtpParam
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(s, " ") {
+		if field == "" {
+			continue
+		}
+
+		key, value, hasValue := strings.Cut(field, "=")
+		if !validParamKeyword(key) || (hasValue && !validParamValue(value)) {
+			return nil, errParamSyntax
+		}
+
+		key = strings.ToUpper(key)
+		if seen[key] {
+			return nil, errParamSyntax
+		}
+		seen[key] = true
+
+		params = append(params, esmtpParam{key: key, value: value})
+	}
+	return params, nil
+}
+
+// esmtp-keyword = (ALPHA / DIGIT) *(ALPHA / DIGIT / "-")
+func validParamKeyword(key string) bool {
+	if key == "" || key[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// esmtp-value = 1*(%d33-60 / %d62-126 / UTF8-non-ascii)
+func validParamValue(value string) bool {
+	if value == "" || !utf8.ValidString(value) {
+		return false
+	}
+	for _, r := range value {
+		if r < utf8.RuneSelf && (r < 33 || r > 126 || r == '=') {
+			return false
+		}
+	}
+	return true
+}
+
+// 校验MAIL FROM的AUTH参数（RFC 4954 5），值为"<>"或xtext编码的邮箱
+func validAuthParam(value string) bool {
+	if value == "<>" {
+		return true
+	}
+	if value == "" {
+		return false
+	}
+	_, err := dsn.DecodeXtext(value)
+	return err == nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParsePathArgs(t *testing.T) {
+	tests := []struct {
+		args    string
+		keyword string
+		address string
+		params  []esmtpParam
+		err     error
+	}{
+		{args: "FROM:<user@Example.COM>", keyword: "FROM", address: "user@example.com"},
+		{args: "from:<>", keyword: "FROM", address: ""},
+		{args: "FROM: <user@example.com>", keyword: "FROM", address: "user@example.com"},
+		{args: "FROM:user@example.com", keyword: "FROM", address: "user@example.com"},
+		{args: "TO:<@relay.example:User@example.com>", keyword: "TO", address: "User@example.com"},
+		{args: `TO:<"a >b"@example.com>`, keyword: "TO", address: `"a >b"@example.com`},
+		{args: `TO:<"a;b"@example.com>`, keyword: "TO", address: `"a;b"@example.com`},
+		{
+			args:    "FROM:<user@example.com> size=1000 BODY=8BITMIME SMTPUTF8",
+			keyword: "FROM",
+			address: "user@example.com",
+			params:  []esmtpParam{{"SIZE", "1000"}, {"BODY", "8BITMIME"}, {"SMTPUTF8", ""}},
+		},
+		{
+			args:    "TO:<user@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;user@example.com",
+			keyword: "TO",
+			address: "user@example.com",
+			params:  []esmtpParam{{"NOTIFY", "SUCCESS,FAILURE"}, {"ORCPT", "rfc822;user@example.com"}},
+		},
+		{args: "TO:<user@example.com>", keyword: "FROM", err: errPathSyntax},
+		{args: "FROM", keyword: "FROM", err: errPathSyntax},
+		{args: "FROM <user@example.com>", keyword: "FROM", err: errPathSyntax},
+		{args: "FROM:", keyword: "FROM", err: errPathSyntax},
+		{args: "FROM:<user@example.com", keyword: "FROM", err: errPathSyntax},
+		{args: "FROM:<user@example.com>SIZE=1", keyword: "FROM", err: errPathSyntax},
+		{args: "TO:<@relay.example>", keyword: "TO", err: errPathSyntax},
+		{args: "FROM:<> SIZE=1 size=2", keyword: "FROM", err: errParamSyntax},
+		{args: "FROM:<> -SIZE=1", keyword: "FROM", err: errParamSyntax},
+		{args: "FROM:<> SIZE=", keyword: "FROM", err: errParamSyntax},
+		{args: "FROM:<> ENVID=a=b", keyword: "FROM", err: errParamSyntax},
+	}
+	for _, tt := range tests {
+		got, err := parsePathArgs(tt.args, tt.keyword)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("parsePathArgs(%q) error = %v, want %v", tt.args, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.address != tt.address {
+			t.Errorf("parsePathArgs(%q) address = %q, want %q", tt.args, got.address, tt.address)
+		}
+		if !slices.Equal(got.params, tt.params) {
+			t.Errorf("parsePathArgs(%q) params = %v, want %v", tt.args, got.params, tt.params)
+		}
+	}
+}
+
+func TestJoinParams(t *testing.T) {
+	params := []esmtpParam{{"NOTIFY", "NEVER"}, {"SMTPUTF8", ""}}
+	if got, want := joinParams(params), "NOTIFY=NEVER SMTPUTF8"; got != want {
+		t.Errorf("joinParams() = %q, want %q", got, want)
+	}
+}
+
+func TestMailPathSyntax(t *testing.T) {
+	_, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(501, "MAIL FROM:<sender@client.test>SIZE=1")
+	c.cmd(501, "MAIL FROM:<sender@client.test> SIZE=1 SIZE=2")
+	c.cmd(501, "MAIL TO:<sender@client.test>")
+
+	// 空的反向路径用于退信
+	c.cmd(250, "MAIL FROM:<>")
+	c.cmd(501, "RCPT TO:<>")
+	c.cmd(250, "RCPT TO:<@relay.example:rcpt@example.test>")
+}
+
+func TestDSNParams(t *testing.T) {
+	srv, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(501, "MAIL FROM:<sender@client.test> RET=BODY")
+	c.cmd(501, "MAIL FROM:<sender@client.test> ENVID=a+zz")
+	c.cmd(250, "MAIL FROM:<sender@client.test> RET=HDRS ENVID=QQ314159")
+	c.cmd(501, "RCPT TO:<rcpt@example.test> NOTIFY=NEVER,SUCCESS")
+	c.cmd(501, "RCPT TO:<rcpt@example.test> ORCPT=rcpt@example.test")
+	c.cmd(555, "RCPT TO:<rcpt@example.test> FOO=BAR")
+	c.cmd(250, "RCPT TO:<rcpt@example.test> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;rcpt@example.test")
+	c.data(250, "Subject: dsn\r\n\r\nbody\r\n")
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("队列中有%d封邮件，期望1封", len(emails))
+	}
+	if got := emails[0].MailParams; got != "RET=HDRS ENVID=QQ314159" {
+		t.Errorf("MailParams = %q", got)
+	}
+	if got := emails[0].RcptParams; len(got) != 1 || got[0] != "NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;rcpt@example.test" {
+		t.Errorf("RcptParams = %q", got)
+	}
+}
+
+func TestValidAuthParam(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"<>", true},
+		{"user@example.com", true},
+		{"e+3Dmc2@example.com", true},
+		{"", false},
+		{"a=b", false},
+		{"user+@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := validAuthParam(tt.value); got != tt.want {
+			t.Errorf("validAuthParam(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// 策略相关状态码
+const (
+	statusSenderRejected    = "550 5.7.1 Sender address rejected: access denied"
+	statusRecipientRejected = "550 5.7.1 Recipient address rejected: access denied"
+	statusTooManyRecipients = "452 4.5.3 Too many recipients"
+)
+
+// 策略规则作用的信封地址
+const (
+	policyMail = "mail" // MAIL FROM 发件人
+	policyRcpt = "rcpt" // RCPT TO 收件人
+)
+
+// policyRule 是一条发件人或收件人策略规则
+type policyRule struct {
+	allow   bool
+	target  string
+	pattern string
+	match   func(addr string) bool
+	reply   string // 拒绝时的响应，为空时使用默认响应
+}
+
+// policy 按顺序匹配规则，第一条匹配的规则决定结果，没有规则匹配时允许
+type policy struct {
+	rules []policyRule
+}
+
+// 加载策略文件，每行格式为 "动作 对象 匹配模式 [响应]"，以#开头的行为注释。
+//
+// 动作为allow或deny，对象为mail（发件人）或rcpt（收件人）。匹配模式支持：
+//
+//	user@example.com    完整地址
+//	@example.com        域名下的所有地址
+//	*@*.example.com     通配符，*匹配任意字符，?匹配单个字符
+//	/^dev-.*@/          正则表达式
+//	<>                  空反向路径（仅用于mail）
+//
+// 响应为可选的 "代码 增强状态码 说明"，例如 "550 5.7.1 Staging may not mail customers"。
+// 地址匹配不区分大小写。
+func loadPolicyFile(path string) (*policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开策略文件时出错: %w", err)
+	}
+	defer f.Close()
+
+	p := &policy{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parsePolicyRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("策略文件第%d行: %w", lineNo, err)
+		}
+		p.rules = append(p.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取策略文件时出错: %w", err)
+	}
+
+	return p, nil
+}
+
+// 解析一条策略规则
+func parsePolicyRule(line string) (policyRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return policyRule{}, fmt.Errorf("格式无效: %q", line)
+	}
+
+	var rule policyRule
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return policyRule{}, fmt.Errorf("未知的动作: %q", fields[0])
+	}
+
+	rule.target = strings.ToLower(fields[1])
+	if rule.target != policyMail && rule.target != policyRcpt {
+		return policyRule{}, fmt.Errorf("未知的对象: %q", fields[1])
+	}
+
+	match, err := compileAddressPattern(fields[2])
+	if err != nil {
+		return policyRule{}, err
+	}
+	rule.pattern = fields[2]
+	rule.match = match
+
+	if len(fields) > 3 {
+		if rule.allow {
+			return policyRule{}, fmt.Errorf("allow 规则不能指定响应")
+		}
+		rule.reply = strings.Join(fields[3:], " ")
+		if !validRejectReply(rule.reply) {
+			return policyRule{}, fmt.Errorf("无效的响应: %q", rule.reply)
+		}
+	}
+
+	return rule, nil
+}
+
+// 将匹配模式编译为匹配函数
+func compileAddressPattern(pattern string) (func(string) bool, error) {
+	switch {
+	case pattern == "<>":
+		return func(addr string) bool { return addr == "" }, nil
+
+	case len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("无效的正则表达式 %q: %w", pattern, err)
+		}
+		return func(addr string) bool { return addr != "" && re.MatchString(addr) }, nil
+
+	case strings.ContainsAny(pattern, "*?"):
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(expr)
+		re := regexp.MustCompile("(?i)^" + expr + "$")
+		return func(addr string) bool { return addr != "" && re.MatchString(addr) }, nil
+
+	case strings.HasPrefix(pattern, "@"):
+		domain := pattern[1:]
+		return func(addr string) bool {
+			at := strings.LastIndexByte(addr, '@')
+			return at >= 0 && strings.EqualFold(addr[at+1:], domain)
+		}, nil
+
+	default:
+		return func(addr string) bool { return strings.EqualFold(addr, pattern) }, nil
+	}
+}
+
+// 拒绝响应必须以4xx或5xx状态码开头
+func validRejectReply(reply string) bool {
+	code, _, _ := strings.Cut(reply, " ")
+	if len(code) != 3 || (code[0] != '4' && code[0] != '5') {
+		return false
+	}
+	return code[1] >= '0' && code[1] <= '9' && code[2] >= '0' && code[2] <= '9'
+}
+
+// check 检查信封地址，返回匹配的拒绝规则，允许时返回nil
+func (p *policy) check(target, addr string) *policyRule {
+	if p == nil {
+		return nil
+	}
+
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if rule.target != target || !rule.match(addr) {
+			continue
+		}
+		if rule.allow {
+			return nil
+		}
+		return rule
+	}
+	return nil
+}
+
+// 拒绝规则对应的响应
+func (r *policyRule) rejectReply() string {
+	switch {
+	case r.reply != "":
+		return r.reply
+	case r.target == policyMail:
+		return statusSenderRejected
+	default:
+		return statusRecipientRejected
+	}
+}
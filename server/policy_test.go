@@ -0,0 +1,163 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ivampiresp/smtp-queue/config"
+)
+
+func TestCompileAddressPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		addr    string
+		want    bool
+	}{
+		{"user@example.com", "user@example.com", true},
+		{"user@example.com", "User@EXAMPLE.com", true},
+		{"user@example.com", "other@example.com", false},
+		{"@example.com", "anyone@example.com", true},
+		{"@example.com", "anyone@Example.COM", true},
+		{"@example.com", "anyone@sub.example.com", false},
+		{"@example.com", "", false},
+		{"*@*.example.com", "user@mail.example.com", true},
+		{"*@*.example.com", "user@example.com", false},
+		{"user?@example.com", "user1@example.com", true},
+		{"user?@example.com", "user12@example.com", false},
+		{"*", "", false},
+		{"/^dev-.*@/", "dev-alice@example.com", true},
+		{"/^dev-.*@/", "DEV-bob@example.com", true},
+		{"/^dev-.*@/", "alice@example.com", false},
+		{"/.*/", "", false},
+		{"<>", "", true},
+		{"<>", "user@example.com", false},
+	}
+	for _, tt := range tests {
+		match, err := compileAddressPattern(tt.pattern)
+		if err != nil {
+			t.Errorf("compileAddressPattern(%q) error = %v", tt.pattern, err)
+			continue
+		}
+		if got := match(tt.addr); got != tt.want {
+			t.Errorf("pattern %q match(%q) = %v, want %v", tt.pattern, tt.addr, got, tt.want)
+		}
+	}
+
+	if _, err := compileAddressPattern("/[/"); err == nil {
+		t.Error("compileAddressPattern(\"/[/\") 应返回错误")
+	}
+}
+
+func TestParsePolicyRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    policyRule
+		wantErr bool
+	}{
+		{line: "allow mail @example.com", want: policyRule{allow: true, target: policyMail, pattern: "@example.com"}},
+		{line: "DENY RCPT *@competitor.example", want: policyRule{target: policyRcpt, pattern: "*@competitor.example"}},
+		{
+			line: "deny rcpt @customer.example 550 5.7.1 Staging may not mail customers",
+			want: policyRule{target: policyRcpt, pattern: "@customer.example", reply: "550 5.7.1 Staging may not mail customers"},
+		},
+		{line: "deny mail", wantErr: true},
+		{line: "reject mail @example.com", wantErr: true},
+		{line: "deny data @example.com", wantErr: true},
+		{line: "deny mail /[/", wantErr: true},
+		{line: "allow mail @example.com 250 OK", wantErr: true},
+		{line: "deny mail @example.com 250 2.0.0 OK", wantErr: true},
+		{line: "deny mail @example.com 5x0 denied", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePolicyRule(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePolicyRule(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.allow != tt.want.allow || got.target != tt.want.target ||
+			got.pattern != tt.want.pattern || got.reply != tt.want.reply {
+			t.Errorf("parsePolicyRule(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	rules := `# 第一条匹配的规则决定结果
+allow rcpt ops@customer.example
+deny rcpt @customer.example 550 5.7.1 Staging may not mail customers
+deny mail <>
+deny rcpt /^noreply@/
+`
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := loadPolicyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		addr   string
+		reply  string // 为空表示允许
+	}{
+		{policyRcpt, "ops@customer.example", ""},
+		{policyRcpt, "alice@customer.example", "550 5.7.1 Staging may not mail customers"},
+		{policyRcpt, "noreply@example.com", statusRecipientRejected},
+		{policyRcpt, "alice@example.com", ""},
+		{policyMail, "", statusSenderRejected},
+		{policyMail, "alice@customer.example", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule := p.check(tt.target, tt.addr); rule != nil {
+			got = rule.rejectReply()
+		}
+		if got != tt.reply {
+			t.Errorf("check(%s, %q) = %q, want %q", tt.target, tt.addr, got, tt.reply)
+		}
+	}
+
+	// 未配置策略时全部允许
+	var none *policy
+	if rule := none.check(policyMail, "alice@example.com"); rule != nil {
+		t.Errorf("nil policy check() = %+v, want nil", rule)
+	}
+}
+
+func TestPolicySession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	rules := "deny mail @spam.example\ndeny rcpt @customer.example 550 5.7.1 Staging may not mail customers\n"
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadPolicyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.MaxRecipients = 2
+	srv := newTestServer(t, cfg)
+	srv.policy = p
+	c := dialTestServer(t, serveTestListener(t, srv, config.ListenerModeStartTLS))
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(550, "MAIL FROM:<bulk@spam.example>")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	if msg := c.cmd(550, "RCPT TO:<alice@customer.example>"); msg != "5.7.1 Staging may not mail customers" {
+		t.Errorf("RCPT 响应 = %q", msg)
+	}
+
+	// 被拒绝的收件人不计入收件人数
+	c.cmd(250, "RCPT TO:<one@example.test>")
+	c.cmd(250, "RCPT TO:<two@example.test>")
+	c.cmd(452, "RCPT TO:<three@example.test>")
+	c.data(250, "Subject: policy\r\n\r\nbody\r\n")
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 读取PROXY协议头的超时时间，负载均衡器会在建立连接后立即发送协议头
+const proxyHeaderTimeout = 10 * time.Second
+
+// PROXY协议v1头的最大长度（含结尾CRLF）
+const proxyV1MaxLength = 107
+
+// PROXY协议v2头的固定签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errInvalidProxyHeader = errors.New("无效的PROXY协议头")
+
+// proxyConn 是经过PROXY协议解析的连接，RemoteAddr返回负载均衡器转发的真实客户端地址
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+// Read 先返回读取协议头时已缓冲的数据
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// RemoteAddr 返回真实客户端地址，协议头未携带地址时返回负载均衡器的地址
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// 判断连接的对端是否是可信的负载均衡器，本机Unix域套接字始终可信
+func (s *Server) isTrustedProxy(conn net.Conn) bool {
+	if conn.LocalAddr().Network() == "unix" {
+		return true
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	return ok && containsIP(s.Config.TrustedProxies, ip)
+}
+
+// readProxyHeader 读取连接开头的PROXY协议头（v1或v2），返回携带真实客户端地址的连接
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+
+	sig, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		remote, err = readProxyV2(reader)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		remote, err = readProxyV1(reader)
+	default:
+		return nil, errInvalidProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// 解析文本格式的v1协议头，例如 "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, errInvalidProxyHeader
+		}
+	}
+
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Split(text, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errInvalidProxyHeader
+	}
+
+	// UNKNOWN 表示负载均衡器无法提供客户端地址（例如健康检查），使用连接本身的地址
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, errInvalidProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	if _, err := netip.ParseAddr(fields[3]); err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// 解析二进制格式的v2协议头
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 {
+		return nil, fmt.Errorf("%w: 不支持的版本 %d", errInvalidProxyHeader, version)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL：负载均衡器自身发起的连接，使用连接本身的地址
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("%w: 未知的命令 %d", errInvalidProxyHeader, command)
+	}
+
+	// 地址族和传输协议，其余组合（UDP、Unix等）不携带可用的客户端地址
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		ip := netip.AddrFrom4([4]byte(payload[0:4]))
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		ip := netip.AddrFrom16([16]byte(payload[0:16]))
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+	default:
+		return nil, nil
+	}
+}
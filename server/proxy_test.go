@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivampiresp/smtp-queue/config"
+)
+
+// 构造v2协议头，command为0（LOCAL）或1（PROXY）
+func proxyV2Header(version, command, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, version<<4|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    string // 为空表示使用连接本身的地址
+		wantErr bool
+	}{
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", want: "192.0.2.1:56324"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n", want: "[2001:db8::1]:56324"},
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"},
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n", wantErr: true},
+		{header: "PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n", wantErr: true},
+		{header: "PROXY TCP6 192.0.2.1 2001:db8::2 56324 25\r\n", wantErr: true},
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n", wantErr: true},
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", wantErr: true},
+		{header: "PROXY TCP4 192.0.2.1 invalid 56324 25\r\n", wantErr: true},
+		{header: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 25\r\n", wantErr: true},
+		{header: "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n", wantErr: true},
+		{header: "PROXY TCP4 192.0.2.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		addr, err := readProxyV1(bufio.NewReader(strings.NewReader(tt.header)))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("readProxyV1(%q) error = %v, wantErr %v", tt.header, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("readProxyV1(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestReadProxyV2(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 56324)
+	binary.BigEndian.PutUint16(ipv6[34:], 25)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "IPv4", header: proxyV2Header(2, 1, 0x11, ipv4), want: "192.0.2.1:56324"},
+		{name: "IPv6", header: proxyV2Header(2, 1, 0x21, ipv6), want: "[2001:db8::1]:56324"},
+		{name: "TLV", header: proxyV2Header(2, 1, 0x11, append(ipv4, 0x04, 0, 1, 0)), want: "192.0.2.1:56324"},
+		{name: "LOCAL", header: proxyV2Header(2, 0, 0x00, nil)},
+		{name: "UDP", header: proxyV2Header(2, 1, 0x12, ipv4)},
+		{name: "版本错误", header: proxyV2Header(1, 1, 0x11, ipv4), wantErr: true},
+		{name: "命令错误", header: proxyV2Header(2, 2, 0x11, ipv4), wantErr: true},
+		{name: "地址过短", header: proxyV2Header(2, 1, 0x11, ipv4[:8]), wantErr: true},
+		{name: "IPv6地址过短", header: proxyV2Header(2, 1, 0x21, ipv4), wantErr: true},
+		{name: "数据不完整", header: proxyV2Header(2, 1, 0x11, ipv4)[:20], wantErr: true},
+	}
+	for _, tt := range tests {
+		addr, err := readProxyV2(bufio.NewReader(bytes.NewReader(tt.header)))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: readProxyV2() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: readProxyV2() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		remote  string
+		wantErr bool
+	}{
+		{name: "v1", data: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO client\r\n", remote: "192.0.2.1:56324"},
+		{name: "v2", data: string(proxyV2Header(2, 1, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25})) + "EHLO client\r\n", remote: "192.0.2.1:56324"},
+		{name: "LOCAL", data: string(proxyV2Header(2, 0, 0x00, nil)) + "EHLO client\r\n", remote: "pipe"},
+		{name: "缺少协议头", data: "EHLO client\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(tt.data))
+			client.Close()
+		}()
+
+		conn, err := readProxyHeader(server)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: readProxyHeader() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			server.Close()
+			continue
+		}
+		if err != nil {
+			server.Close()
+			continue
+		}
+
+		if got := conn.RemoteAddr().String(); got != tt.remote {
+			t.Errorf("%s: RemoteAddr() = %q, want %q", tt.name, got, tt.remote)
+		}
+		// 协议头之后的数据必须原样保留
+		rest, _ := io.ReadAll(conn)
+		if string(rest) != "EHLO client\r\n" {
+			t.Errorf("%s: 协议头之后的数据 = %q", tt.name, rest)
+		}
+		conn.Close()
+	}
+}
+
+// 连接启用了PROXY协议的监听器，发送协议头后返回连接
+func dialProxied(t *testing.T, addr, header string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write([]byte(header)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	cfg := testConfig()
+	cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	cfg.DeniedNetworks = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	srv := newTestServer(t, cfg)
+	addr := serveListenerConfig(t, srv, config.ListenerConfig{Addr: "127.0.0.1:0", Mode: config.ListenerModeStartTLS, ProxyProtocol: true})
+
+	// 访问控制使用协议头中的客户端地址，而不是代理的地址
+	conn := dialProxied(t, addr, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, _, err := textproto.NewReader(bufio.NewReader(conn)).ReadResponse(554); err != nil {
+		t.Errorf("被拒绝网段的客户端: %v", err)
+	}
+
+	c := newTestClient(t, dialProxied(t, addr, "PROXY TCP4 198.51.100.7 198.51.100.1 56324 25\r\n"))
+	c.cmd(250, "EHLO client.test")
+
+	// 缺少协议头的连接被断开
+	conn = dialProxied(t, addr, "EHLO client.test\r\n")
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyProtocolUntrustedProxy(t *testing.T) {
+	cfg := testConfig()
+	cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	srv := newTestServer(t, cfg)
+	addr := serveListenerConfig(t, srv, config.ListenerConfig{Addr: "127.0.0.1:0", Mode: config.ListenerModeStartTLS, ProxyProtocol: true})
+
+	conn := dialProxied(t, addr, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("不受信任的代理收到了响应: %q", data)
+	}
+}
+
+func TestProxyProtocolRequiresTrustedProxies(t *testing.T) {
+	srv := newTestServer(t, testConfig())
+	if _, err := srv.listen(config.ListenerConfig{Addr: "127.0.0.1:0", Mode: config.ListenerModeStartTLS, ProxyProtocol: true}); err == nil {
+		t.Error("未配置TRUSTED_PROXIES时应当拒绝启用PROXY协议")
+	}
+}
@@ -2,97 +2,296 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/ivampiresp/smtp-queue/config"
 	"github.com/ivampiresp/smtp-queue/db"
+	"github.com/ivampiresp/smtp-queue/dsn"
 	"github.com/rs/zerolog/log"
 )
 
-// 服务器状态码
+// 服务器状态码（附带RFC 3463增强状态码）
 const (
-	statusReady             = "220 SMTP Queue Server Ready"
-	statusOK                = "250 OK"
-	statusStartMail         = "250 Go ahead"
+	statusOK                = "250 2.0.0 OK"
+	statusStartMail         = "250 2.1.0 Go ahead"
+	statusRcptOK            = "250 2.1.5 OK"
 	statusDataReady         = "354 Start mail input; end with <CRLF>.<CRLF>"
-	statusClosing           = "221 Bye"
-	statusCommandUnknown    = "500 Command unrecognized"
-	statusSyntaxError       = "501 Syntax error"
-	statusCommandNotImplErr = "502 Command not implemented"
-	statusBadSequence       = "503 Bad sequence of commands"
+	statusClosing           = "221 2.0.0 Bye"
+	statusCommandUnknown    = "500 5.5.2 Command unrecognized"
+	statusSyntaxError       = "501 5.5.4 Syntax error"
+	statusCommandNotImplErr = "502 5.5.1 Command not implemented"
+	statusBadSequence       = "503 5.5.1 Bad sequence of commands"
+	statusParamNotImpl      = "555 5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented"
 )
 
 // Server 是一个简单的SMTP服务器，它接收邮件并将其添加到发送队列中
 type Server struct {
-	DB     *db.DB
+	Store  db.Store
 	Config *config.Config
 
-	listener net.Listener
+	mu        sync.Mutex
+	listeners []net.Listener
+	tlsConfig *tls.Config
+	auth      Authenticator
+	policy    *policy
+	limits    *limits
 }
 
 // New 创建新的SMTP服务器实例
-func New(database *db.DB, cfg *config.Config) *Server {
+func New(store db.Store, cfg *config.Config) *Server {
 	return &Server{
-		DB:     database,
+		Store:  store,
 		Config: cfg,
+		limits: newLimits(cfg),
 	}
 }
 
-// Start 启动SMTP服务器
+// Start 启动SMTP服务器，为每个配置的监听器接受连接，直到全部监听器关闭
 func (s *Server) Start() error {
 	var err error
-	s.listener, err = net.Listen("tcp", s.Config.ListenAddr)
+	s.tlsConfig, err = loadTLSConfig(s.Config)
 	if err != nil {
 		return err
 	}
 
-	log.Info().Str("addr", s.Config.ListenAddr).Msg("SMTP服务器开始监听")
+	if s.Config.TLSRequired && s.tlsConfig == nil {
+		return errors.New("已启用TLS_REQUIRED但未配置TLS证书")
+	}
 
+	// 加载客户端凭据
+	if s.Config.AuthUsersFile != "" {
+		auth, err := loadCredentialsFile(s.Config.AuthUsersFile)
+		if err != nil {
+			return err
+		}
+		s.auth = auth
+		log.Info().Int("users", len(auth.users)).Msg("已加载客户端凭据")
+	}
+
+	if s.Config.AuthRequired && s.auth == nil {
+		return errors.New("已启用AUTH_REQUIRED但未配置AUTH_USERS_FILE")
+	}
+	if s.auth != nil && s.tlsConfig == nil && !s.Config.AllowInsecureAuth {
+		log.Warn().Msg("未配置TLS证书，AUTH只在Unix套接字上提供；如需在明文连接上认证请设置ALLOW_INSECURE_AUTH")
+	}
+
+	// 加载发件人和收件人策略
+	if s.Config.PolicyFile != "" {
+		p, err := loadPolicyFile(s.Config.PolicyFile)
+		if err != nil {
+			return err
+		}
+		s.policy = p
+		log.Info().Int("rules", len(p.rules)).Msg("已加载投递策略")
+	}
+
+	// 先打开全部监听器，任何一个失败都不启动服务
+	listeners := make([]net.Listener, 0, len(s.Config.Listeners))
+	for _, lc := range s.Config.Listeners {
+		ln, err := s.listen(lc)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	s.mu.Lock()
+	s.listeners = listeners
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener, lc config.ListenerConfig) {
+			defer wg.Done()
+			s.serve(ln, lc)
+		}(ln, s.Config.Listeners[i])
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// 根据监听器配置打开监听套接字
+func (s *Server) listen(lc config.ListenerConfig) (net.Listener, error) {
+	if lc.Mode == config.ListenerModeTLS && s.tlsConfig == nil {
+		return nil, fmt.Errorf("监听器 %s 使用隐式TLS但未配置TLS证书", lc.Addr)
+	}
+
+	_, unix := unixSocketPath(lc.Addr)
+	if s.Config.TLSRequired && lc.Mode == config.ListenerModePlain && !unix {
+		log.Warn().Str("addr", lc.Addr).Msg("已启用TLS_REQUIRED，明文监听器上的客户端将无法投递邮件")
+	}
+	if lc.ProxyProtocol && !unix && len(s.Config.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("监听器 %s 启用了PROXY协议但未配置TRUSTED_PROXIES", lc.Addr)
+	}
+
+	var ln net.Listener
+	var err error
+	if path, ok := unixSocketPath(lc.Addr); ok {
+		ln, err = listenUnix(path, s.Config)
+	} else {
+		ln, err = net.Listen("tcp", lc.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("addr", lc.Addr).Str("mode", lc.Mode).Bool("proxy_protocol", lc.ProxyProtocol).Msg("SMTP服务器开始监听")
+	return ln, nil
+}
+
+// 在单个监听器上接受连接
+func (s *Server) serve(ln net.Listener, lc config.ListenerConfig) {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				return nil
+				return
 			}
-			log.Error().Err(err).Msg("接受连接时出错")
+			log.Error().Err(err).Str("addr", lc.Addr).Msg("接受连接时出错")
 			continue
 		}
 
-		go s.handleConnection(conn)
+		go s.handleConnection(conn, lc)
 	}
 }
 
-// Stop 停止SMTP服务器
+// Stop 停止SMTP服务器，关闭全部监听器并删除Unix域套接字文件
 func (s *Server) Stop() error {
-	if s.listener != nil {
-		return s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, ln := range s.listeners {
+		if err := ln.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	s.listeners = nil
+	return firstErr
 }
 
 // 处理客户端连接
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(conn net.Conn, lc config.ListenerConfig) {
 	defer conn.Close()
 
-	log.Info().Str("client", conn.RemoteAddr().String()).Msg("客户端连接")
+	// 在负载均衡器之后运行时，从PROXY协议头中恢复真实客户端地址
+	local := conn.LocalAddr().Network() == "unix"
+	if lc.ProxyProtocol {
+		if !s.isTrustedProxy(conn) {
+			log.Warn().Str("client", conn.RemoteAddr().String()).Str("listener", lc.Addr).Msg("拒绝来自不受信任代理的连接")
+			return
+		}
+
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			log.Warn().Err(err).Str("proxy", conn.RemoteAddr().String()).Msg("读取PROXY协议头失败")
+			return
+		}
+		conn = proxied
+
+		// 经由代理转发的客户端不再视为本机客户端
+		local = local && conn.RemoteAddr().Network() == "unix"
+	}
+
+	// 在TLS握手和欢迎消息之前检查访问控制，Unix套接字由文件权限控制访问。
+	// 隐式TLS监听器直接关闭被拒绝的连接，无需为其完成握手
+	ip, ok := addrIP(conn.RemoteAddr())
+	if !local && !s.allowConnection(ip, ok) {
+		log.Warn().Str("client", conn.RemoteAddr().String()).Msg("拒绝来自不允许网络的连接")
+		if lc.Mode != config.ListenerModeTLS {
+			conn.SetDeadline(time.Now().Add(rejectTimeout))
+			fmt.Fprintf(conn, "%s\r\n", statusAccessDenied)
+		}
+		return
+	}
+
+	// 隐式TLS从第一个字节（PROXY协议头之后）开始加密
+	if lc.Mode == config.ListenerModeTLS {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+
+	// 检查并发连接数限制
+	if !s.limits.acquireConnection(ip, ok) {
+		conn.SetDeadline(time.Now().Add(rejectTimeout))
+		fmt.Fprintf(conn, "%s\r\n", statusTooManyConnections)
+		return
+	}
+	defer s.limits.releaseConnection(ip, ok)
+
+	log.Info().Str("client", conn.RemoteAddr().String()).Str("listener", lc.Addr).Int("connections", s.limits.activeConnections()).Msg("客户端连接")
 
-	// 设置连接超时
-	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	// TLS握手和欢迎消息使用问候超时，之后每条命令分别设置超时
+	conn.SetDeadline(time.Now().Add(s.Config.GreetingTimeout))
+
+	// 明文和LMTP监听器不提供STARTTLS
+	tlsConfig := s.tlsConfig
+	if lc.Mode == config.ListenerModePlain || lc.Mode == config.ListenerModeLMTP {
+		tlsConfig = nil
+	}
 
 	// 创建会话
-	session := newSession(conn, s.DB, s.Config)
+	session := newSession(conn, s, tlsConfig)
+	session.local = local
+	session.trusted = local || s.isTrusted(ip, ok)
+	session.lmtp = lc.Mode == config.ListenerModeLMTP
+
+	// 隐式TLS连接在发送欢迎消息前完成握手
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Error().Err(err).Str("client", conn.RemoteAddr().String()).Msg("TLS握手失败")
+			return
+		}
+		state := tlsConn.ConnectionState()
+		session.tlsState = &state
+	}
 
 	// 发送欢迎消息
-	session.send(statusReady)
+	protocol := "ESMTP"
+	if session.lmtp {
+		protocol = "LMTP"
+	}
+	session.send(fmt.Sprintf("220 %s %s SMTP Queue Server Ready", s.Config.Hostname, protocol))
 
-	// 处理会话
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		if err := session.handleCommand(scanner.Text()); err != nil {
+	// 处理会话，STARTTLS 之后 session.reader 会被替换为读取加密连接的新实例
+	for {
+		line, err := session.readLine()
+		if errors.Is(err, errLineTooLong) {
+			session.send(statusLineTooLong)
+			continue
+		}
+		if isTimeout(err) {
+			log.Warn().Str("client", conn.RemoteAddr().String()).Msg("等待客户端命令超时")
+			session.replyTimeout()
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Error().Err(err).Msg("读取客户端数据时出错")
+			}
+			break
+		}
+
+		if err := session.handleCommand(line); err != nil {
+			if isTimeout(err) {
+				log.Warn().Str("client", conn.RemoteAddr().String()).Msg("接收客户端数据超时")
+				session.replyTimeout()
+				break
+			}
 			log.Error().Err(err).Msg("处理命令时出错")
 			break
 		}
@@ -103,50 +302,112 @@ func (s *Server) handleConnection(conn net.Conn) {
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Error().Err(err).Msg("读取客户端数据时出错")
+	if err := session.flush(); err != nil {
+		log.Debug().Err(err).Msg("发送响应时出错")
 	}
 
+	// 清理未完成事务的临时文件
+	session.reset()
+
 	log.Info().Str("client", conn.RemoteAddr().String()).Msg("客户端断开连接")
 }
 
 // smtpSession 表示一个SMTP会话
 type smtpSession struct {
-	conn net.Conn
-	db   *db.DB
-	cfg  *config.Config
+	conn      net.Conn
+	reader    *bufio.Reader
+	writer    *bufio.Writer
+	store     db.Store
+	cfg       *config.Config
+	tlsConfig *tls.Config
+	auth      Authenticator
+	policy    *policy
+	limits    *limits
+
+	// TLS连接状态，未加密时为nil
+	tlsState *tls.ConnectionState
 
 	// 会话状态
-	helo     string
-	mailFrom string
-	rcptTo   []string
-	data     []string
-	inData   bool
-	quit     bool
+	helo          string
+	esmtp         bool
+	local         bool // 通过Unix套接字连接的本机客户端
+	trusted       bool
+	lmtp          bool
+	authUser      string
+	authFailures  int // 本会话中认证失败的次数
+	inTransaction bool
+	mailFrom      string
+	mailParams    []esmtpParam
+	bodyType      string
+	smtputf8      bool
+	rcptTo        []string
+	rcptParams    [][]esmtpParam // 与rcptTo一一对应
+	chunks        *dataSpool     // BDAT 数据块，未使用BDAT时为nil
+	quit          bool
 }
 
 // 创建新的SMTP会话
-func newSession(conn net.Conn, database *db.DB, cfg *config.Config) *smtpSession {
-	return &smtpSession{
-		conn: conn,
-		db:   database,
-		cfg:  cfg,
+func newSession(conn net.Conn, srv *Server, tlsConfig *tls.Config) *smtpSession {
+	s := &smtpSession{
+		conn:      conn,
+		store:     srv.Store,
+		cfg:       srv.Config,
+		tlsConfig: tlsConfig,
+		auth:      srv.auth,
+		policy:    srv.policy,
+		limits:    srv.limits,
 	}
+	s.resetIO()
+	return s
+}
+
+// 基于当前连接重新创建读写缓冲，丢弃已缓冲但未处理的输入
+func (s *smtpSession) resetIO() {
+	s.reader = bufio.NewReader(s.conn)
+	s.writer = bufio.NewWriter(s.conn)
 }
 
 // 发送响应到客户端
+//
+// 响应先写入缓冲区，由flush或flushIfIdle在同步点统一发出（RFC 2920）。
 func (s *smtpSession) send(message string) {
-	fmt.Fprintf(s.conn, "%s\r\n", message)
+	fmt.Fprintf(s.writer, "%s\r\n", message)
+}
+
+// 立即发出所有缓冲的响应
+func (s *smtpSession) flush() error {
+	return s.writer.Flush()
+}
+
+// 在等待客户端输入之前发出缓冲的响应
+//
+// 客户端使用流水线时，同一批命令可能已经全部到达读缓冲区；
+// 只要还有完整的命令待处理，就继续积攒响应，直到整批处理完毕再一次性发出。
+func (s *smtpSession) flushIfIdle() error {
+	if n := s.reader.Buffered(); n > 0 {
+		buf, err := s.reader.Peek(n)
+		if err == nil && bytes.IndexByte(buf, '\n') >= 0 {
+			return nil
+		}
+	}
+	return s.flush()
+}
+
+// 发送多行响应到客户端，除最后一行外均使用"code-"前缀
+func (s *smtpSession) sendLines(code string, lines []string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		s.send(code + sep + line)
+	}
 }
 
 // 处理SMTP命令
 func (s *smtpSession) handleCommand(line string) error {
 	log.Debug().Str("line", line).Msg("收到命令")
 
-	if s.inData {
-		return s.handleData(line)
-	}
-
 	// 拆分命令和参数
 	parts := strings.SplitN(line, " ", 2)
 	command := strings.ToUpper(parts[0])
@@ -155,15 +416,34 @@ func (s *smtpSession) handleCommand(line string) error {
 		args = parts[1]
 	}
 
+	// LMTP 使用LHLO代替HELO/EHLO（RFC 2033 4.1）
+	if s.lmtp {
+		switch command {
+		case "LHLO":
+			return s.handleHelo(args, true)
+		case "HELO", "EHLO":
+			s.send(statusCommandUnknown)
+			return nil
+		}
+	}
+
 	switch command {
-	case "HELO", "EHLO":
-		return s.handleHelo(args)
+	case "HELO":
+		return s.handleHelo(args, false)
+	case "EHLO":
+		return s.handleHelo(args, true)
 	case "MAIL":
 		return s.handleMail(args)
 	case "RCPT":
 		return s.handleRcpt(args)
 	case "DATA":
 		return s.handleDataCommand()
+	case "BDAT":
+		return s.handleBdat(args)
+	case "STARTTLS":
+		return s.handleStartTLS(args)
+	case "AUTH":
+		return s.handleAuth(args)
 	case "RSET":
 		return s.handleRset()
 	case "NOOP":
@@ -178,14 +458,27 @@ func (s *smtpSession) handleCommand(line string) error {
 }
 
 // 处理HELO/EHLO命令
-func (s *smtpSession) handleHelo(args string) error {
-	if args == "" {
+func (s *smtpSession) handleHelo(args string, esmtp bool) error {
+	// 主机名会写入Received头，拒绝包含控制字符的参数
+	if args == "" || strings.ContainsFunc(args, unicode.IsControl) {
 		s.send(statusSyntaxError)
 		return nil
 	}
 
+	// HELO/EHLO 隐含RSET，丢弃进行中的事务
+	s.reset()
+
 	s.helo = args
-	s.send(statusOK)
+	s.esmtp = esmtp
+
+	if !esmtp {
+		s.send(fmt.Sprintf("250 %s", s.cfg.Hostname))
+		return nil
+	}
+
+	// EHLO 响应首行为主机名，其后每行通告一个扩展
+	lines := append([]string{fmt.Sprintf("%s greets %s", s.cfg.Hostname, args)}, s.capabilities()...)
+	s.sendLines("250", lines)
 	return nil
 }
 
@@ -196,46 +489,191 @@ func (s *smtpSession) handleMail(args string) error {
 		return nil
 	}
 
-	if !strings.HasPrefix(strings.ToUpper(args), "FROM:") {
-		s.send(statusSyntaxError)
+	// 要求加密时必须先完成STARTTLS。LMTP监听器不提供STARTTLS，
+	// Unix套接字上的连接不经过网络，二者均无需加密
+	if s.cfg.TLSRequired && s.tlsState == nil && !s.lmtp && !s.local {
+		s.send(statusTLSRequired)
+		return nil
+	}
+
+	// 要求认证时，除受信任网络外必须先完成AUTH
+	if s.authRequired() {
+		s.send(statusAuthRequired)
 		return nil
 	}
 
-	// 提取邮件地址
-	mailFrom := strings.ToLower(args[5:])
-	mailFrom = strings.Trim(mailFrom, "<>")
-	if mailFrom == "" {
+	// 不允许嵌套的邮件事务
+	if s.inTransaction {
+		s.send(statusBadSequence)
+		return nil
+	}
+
+	// 解析反向路径和ESMTP参数
+	mail, err := parsePathArgs(args, "FROM")
+	if err != nil {
 		s.send(statusSyntaxError)
 		return nil
 	}
 
-	s.mailFrom = mailFrom
+	// 参数仅在EHLO会话中有效
+	if len(mail.params) > 0 && !s.esmtp {
+		s.send(statusParamNotImpl)
+		return nil
+	}
+
+	bodyType := ""
+	smtputf8 := false
+	var params []esmtpParam
+	for _, param := range mail.params {
+		switch param.key {
+		case "SIZE":
+			size, err := strconv.ParseInt(param.value, 10, 64)
+			if err != nil || size < 0 {
+				s.send(statusSyntaxError)
+				return nil
+			}
+			// 客户端声明的大小超过限制时直接拒绝，无需等到DATA
+			if s.cfg.MaxMessageSize > 0 && size > s.cfg.MaxMessageSize {
+				s.send(statusMessageTooLarge)
+				return nil
+			}
+		case "BODY":
+			switch strings.ToUpper(param.value) {
+			case "7BIT", "8BITMIME", "BINARYMIME":
+				bodyType = strings.ToUpper(param.value)
+			default:
+				s.send(statusParamNotImpl)
+				return nil
+			}
+		case "SMTPUTF8":
+			if param.value != "" {
+				s.send(statusSyntaxError)
+				return nil
+			}
+			smtputf8 = true
+		case "RET":
+			if !dsn.ValidRet(param.value) {
+				s.send(statusSyntaxError)
+				return nil
+			}
+		case "ENVID":
+			if !dsn.ValidEnvID(param.value) {
+				s.send(statusSyntaxError)
+				return nil
+			}
+		case "AUTH":
+			// RFC 4954 5：启用AUTH时必须接受该参数，值为xtext编码的邮箱或"<>"。
+			// 队列不会将其转发给上游，因此校验后忽略
+			if s.auth == nil {
+				s.send(statusParamNotImpl)
+				return nil
+			}
+			if !validAuthParam(param.value) {
+				s.send(statusSyntaxError)
+				return nil
+			}
+			continue
+		default:
+			s.send(statusParamNotImpl)
+			return nil
+		}
+		params = append(params, param)
+	}
+
+	// 空反向路径"<>"用于退信等通知邮件，无需校验
+	// 只有声明了SMTPUTF8的事务才接受非ASCII地址
+	if mail.address != "" {
+		if err := validateAddress(mail.address, smtputf8); err != nil {
+			s.send(addressStatus(err))
+			return nil
+		}
+	}
+
+	if rule := s.policy.check(policyMail, mail.address); rule != nil {
+		log.Warn().Str("from", mail.address).Str("rule", rule.pattern).Msg("发件人被策略拒绝")
+		s.send(rule.rejectReply())
+		return nil
+	}
+
+	if !s.allowMessage() {
+		s.send(statusMessageRateLimit)
+		return nil
+	}
+
+	s.inTransaction = true
+	s.mailFrom = mail.address
+	s.mailParams = params
+	s.bodyType = bodyType
+	s.smtputf8 = smtputf8
 	s.send(statusStartMail)
 	return nil
 }
 
 // 处理RCPT TO命令
 func (s *smtpSession) handleRcpt(args string) error {
-	if s.mailFrom == "" {
+	if !s.inTransaction {
 		s.send(statusBadSequence)
 		return nil
 	}
 
-	if !strings.HasPrefix(strings.ToUpper(args), "TO:") {
+	// 解析正向路径和ESMTP参数
+	rcpt, err := parsePathArgs(args, "TO")
+	if err != nil || rcpt.address == "" {
 		s.send(statusSyntaxError)
 		return nil
 	}
 
-	// 提取邮件地址
-	rcptTo := strings.ToLower(args[3:])
-	rcptTo = strings.Trim(rcptTo, "<>")
-	if rcptTo == "" {
-		s.send(statusSyntaxError)
+	// 参数仅在EHLO会话中有效
+	if len(rcpt.params) > 0 && !s.esmtp {
+		s.send(statusParamNotImpl)
 		return nil
 	}
 
-	s.rcptTo = append(s.rcptTo, rcptTo)
-	s.send(statusOK)
+	for _, param := range rcpt.params {
+		switch param.key {
+		case "NOTIFY":
+			if _, err := dsn.ParseNotify(param.value); err != nil {
+				s.send(statusSyntaxError)
+				return nil
+			}
+		case "ORCPT":
+			if !dsn.ValidORCPT(param.value) {
+				s.send(statusSyntaxError)
+				return nil
+			}
+		default:
+			s.send(statusParamNotImpl)
+			return nil
+		}
+	}
+
+	// RFC 5321 要求接受不带域名的 <Postmaster>
+	if !strings.EqualFold(rcpt.address, "postmaster") {
+		if err := validateAddress(rcpt.address, s.smtputf8); err != nil {
+			s.send(addressStatus(err))
+			return nil
+		}
+	}
+
+	if s.cfg.MaxRecipients > 0 && len(s.rcptTo) >= s.cfg.MaxRecipients {
+		s.send(statusTooManyRecipients)
+		return nil
+	}
+
+	if rule := s.policy.check(policyRcpt, rcpt.address); rule != nil {
+		log.Warn().Str("from", s.mailFrom).Str("to", rcpt.address).Str("rule", rule.pattern).Msg("收件人被策略拒绝")
+		s.send(rule.rejectReply())
+		return nil
+	}
+
+	if !s.allowRecipient() {
+		s.send(statusRecipientRateLimit)
+		return nil
+	}
+
+	s.rcptTo = append(s.rcptTo, rcpt.address)
+	s.rcptParams = append(s.rcptParams, rcpt.params)
+	s.send(statusRcptOK)
 	return nil
 }
 
@@ -246,48 +684,67 @@ func (s *smtpSession) handleDataCommand() error {
 		return nil
 	}
 
-	s.inData = true
-	s.send(statusDataReady)
-	return nil
-}
-
-// 处理DATA内容
-func (s *smtpSession) handleData(line string) error {
-	// 数据结束标记
-	if line == "." {
-		s.inData = false
+	// 同一事务中不能混用BDAT和DATA
+	if s.chunks != nil {
+		s.send(statusDataAfterBDAT)
+		return nil
+	}
 
-		// 处理邮件
-		if err := s.processEmail(); err != nil {
-			log.Error().Err(err).Msg("处理邮件时出错")
-			s.send(fmt.Sprintf("554 Transaction failed: %s", err.Error()))
-			return nil
-		}
+	// 二进制内容无法使用基于行的DATA传输
+	if s.bodyType == "BINARYMIME" {
+		s.send(statusBinaryMIMENeedsBDAT)
+		return nil
+	}
 
-		s.send(statusOK)
+	// 邮件内容写入临时文件，避免整封邮件驻留内存
+	spool, err := newDataSpool()
+	if err != nil {
+		log.Error().Err(err).Msg("创建临时文件时出错")
+		s.send(statusLocalError)
 		return nil
 	}
+	defer spool.Close()
+
+	s.send(statusDataReady)
 
-	// 处理行首的点
-	if strings.HasPrefix(line, ".") {
-		line = line[1:]
+	if err := s.readData(spool, s.cfg.MaxMessageSize); err != nil {
+		if errors.Is(err, errMessageTooLarge) {
+			log.Warn().Int64("max_size", s.cfg.MaxMessageSize).Msg("邮件超过大小限制，已拒绝")
+			s.replyMessage(statusMessageTooLarge)
+			s.reset()
+			return nil
+		}
+		return err
 	}
 
-	s.data = append(s.data, line)
+	s.completeMessage(spool)
 	return nil
 }
 
 // 处理RSET命令
 func (s *smtpSession) handleRset() error {
-	s.mailFrom = ""
-	s.rcptTo = nil
-	s.data = nil
-	s.inData = false
+	s.reset()
 
 	s.send(statusOK)
 	return nil
 }
 
+// 重置邮件事务状态
+func (s *smtpSession) reset() {
+	s.inTransaction = false
+	s.mailFrom = ""
+	s.mailParams = nil
+	s.bodyType = ""
+	s.smtputf8 = false
+	s.rcptTo = nil
+	s.rcptParams = nil
+
+	if s.chunks != nil {
+		s.chunks.Close()
+		s.chunks = nil
+	}
+}
+
 // 处理QUIT命令
 func (s *smtpSession) handleQuit() error {
 	s.send(statusClosing)
@@ -295,15 +752,26 @@ func (s *smtpSession) handleQuit() error {
 	return nil
 }
 
-// 处理接收到的邮件
-func (s *smtpSession) processEmail() error {
-	if len(s.data) == 0 {
-		return errors.New("邮件内容为空")
+// 处理接收到的邮件，成功时返回队列标识
+func (s *smtpSession) processEmail(spool *dataSpool) (string, error) {
+	if spool.size == 0 {
+		return "", errors.New("邮件内容为空")
+	}
+
+	// 保留原始邮件内容，只加入追踪头并补充缺少的Message-ID和Date
+	body, err := spool.Reader()
+	if err != nil {
+		return "", fmt.Errorf("读取临时文件时出错: %w", err)
+	}
+	queueID := db.NewQueueID()
+	content, header, err := s.buildContent(body, spool.size, queueID)
+	if err != nil {
+		return "", fmt.Errorf("读取临时文件时出错: %w", err)
 	}
 
-	// 解析邮件内容以获取主题（用于日志记录）
+	// 解析邮件头以获取主题（用于日志记录）
 	var subject string
-	for _, line := range s.data {
+	for _, line := range strings.Split(header, "\n") {
 		if strings.HasPrefix(strings.ToLower(line), "subject:") {
 			subject = strings.TrimSpace(line[8:])
 			break
@@ -322,21 +790,30 @@ func (s *smtpSession) processEmail() error {
 	if s.cfg.SMTPFrom == "" {
 		log.Warn().Str("client_from", clientFrom).Msg("未配置SMTP_FROM，邮件可能无法发送")
 	} else {
-		log.Info().Str("client_from", clientFrom).Str("actual_from", s.cfg.SMTPFrom).Msg("使用配置的发件人替代客户端发件人")
+		log.Info().Str("client_from", clientFrom).Str("actual_from", s.cfg.SMTPFrom).Str("auth_user", s.authUser).Msg("使用配置的发件人替代客户端发件人")
 	}
 
-	// 保留原始邮件内容，包括所有邮件头和正文
-	originalContent := strings.Join(s.data, "\r\n")
+	// 保存ESMTP参数，供转发时使用
+	rcptParams := make([]string, len(s.rcptParams))
+	for i, params := range s.rcptParams {
+		rcptParams[i] = joinParams(params)
+	}
 
-	_, err := s.db.QueueEmail(clientFrom, s.rcptTo, subject, originalContent)
+	err = s.store.Enqueue(&db.Email{
+		QueueID:    queueID,
+		From:       clientFrom,
+		To:         s.rcptTo,
+		Subject:    subject,
+		Body:       content,
+		BodyType:   s.bodyType,
+		MailParams: joinParams(s.mailParams),
+		RcptParams: rcptParams,
+		AuthUser:   s.authUser,
+	})
 	if err != nil {
-		return fmt.Errorf("将邮件添加到队列时出错: %w", err)
+		return "", fmt.Errorf("将邮件添加到队列时出错: %w", err)
 	}
 
-	// 重置会话状态
-	s.mailFrom = ""
-	s.rcptTo = nil
-	s.data = nil
-
-	return nil
+	log.Info().Str("queue_id", queueID).Str("from", clientFrom).Strs("to", s.rcptTo).Msg("邮件已加入队列")
+	return queueID, nil
 }
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivampiresp/smtp-queue/config"
+	"github.com/ivampiresp/smtp-queue/db"
+)
+
+// 测试使用的配置
+func testConfig() *config.Config {
+	return &config.Config{
+		Hostname:               "mx.test",
+		SMTPFrom:               "relay@mx.test",
+		GreetingTimeout:        10 * time.Second,
+		MailTimeout:            10 * time.Second,
+		RcptTimeout:            10 * time.Second,
+		DataBlockTimeout:       10 * time.Second,
+		DataTerminationTimeout: 10 * time.Second,
+	}
+}
+
+// 创建使用临时数据库的测试服务器
+func newTestServer(t *testing.T, cfg *config.Config) *Server {
+	t.Helper()
+
+	database, err := db.Init(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return New(database, cfg)
+}
+
+// 在本机随机端口上打开指定模式的监听器，返回监听地址
+func serveTestListener(t *testing.T, srv *Server, mode string) string {
+	t.Helper()
+
+	return serveListenerConfig(t, srv, config.ListenerConfig{Addr: "127.0.0.1:0", Mode: mode})
+}
+
+// 按监听器配置打开监听器并在后台接受连接，返回监听地址
+func serveListenerConfig(t *testing.T, srv *Server, lc config.ListenerConfig) string {
+	t.Helper()
+
+	ln, err := srv.listen(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go srv.serve(ln, lc)
+	return ln.Addr().String()
+}
+
+// 启动提供STARTTLS的测试服务器，返回服务器和监听地址
+func startTestServer(t *testing.T, cfg *config.Config) (*Server, string) {
+	t.Helper()
+
+	srv := newTestServer(t, cfg)
+	return srv, serveTestListener(t, srv, config.ListenerModeStartTLS)
+}
+
+// testClient 是测试用的SMTP客户端
+type testClient struct {
+	*textproto.Conn
+	t    *testing.T
+	conn net.Conn
+}
+
+// 连接测试服务器并读取欢迎消息
+func dialTestServer(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestClient(t, conn)
+}
+
+// 在已建立的连接上创建测试客户端并读取欢迎消息
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c := &testClient{Conn: textproto.NewConn(conn), t: t, conn: conn}
+	t.Cleanup(func() { c.Close() })
+	c.expect(220)
+	return c
+}
+
+// 读取一个响应并检查响应码，返回响应内容
+func (c *testClient) expect(code int) string {
+	c.t.Helper()
+
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		c.t.Fatalf("期望响应码 %d: %v", code, err)
+	}
+	return msg
+}
+
+// 发送一条命令并检查响应码，返回响应内容
+func (c *testClient) cmd(code int, format string, args ...any) string {
+	c.t.Helper()
+
+	if err := c.PrintfLine(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(code)
+}
+
+// 发送DATA命令和邮件内容，检查最终响应码
+func (c *testClient) data(code int, body string) string {
+	c.t.Helper()
+
+	c.cmd(354, "DATA")
+	w := c.DotWriter()
+	if _, err := w.Write([]byte(body)); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(code)
+}
+
+func TestEHLOCapabilities(t *testing.T) {
+	_, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	lines := strings.Split(c.cmd(250, "EHLO client.test"), "\n")
+	if lines[0] != "mx.test greets client.test" {
+		t.Errorf("EHLO 首行 = %q", lines[0])
+	}
+	if want := []string{"SIZE 0", "PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "CHUNKING", "BINARYMIME", "SMTPUTF8", "DSN"}; !slices.Equal(lines[1:], want) {
+		t.Errorf("EHLO 通告的扩展 = %q, want %q", lines[1:], want)
+	}
+
+	c.cmd(250, "MAIL FROM:<sender@client.test> BODY=8BITMIME SIZE=1000")
+	c.cmd(250, "RSET")
+
+	// 未通告的扩展参数
+	c.cmd(555, "MAIL FROM:<sender@client.test> FOO=BAR")
+}
+
+func TestHELOHasNoExtensions(t *testing.T) {
+	_, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	if msg := c.cmd(250, "HELO client.test"); msg != "mx.test" {
+		t.Errorf("HELO 响应 = %q", msg)
+	}
+
+	// ESMTP参数仅在EHLO会话中有效
+	c.cmd(555, "MAIL FROM:<sender@client.test> BODY=8BITMIME")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.data(250, "Subject: hello\r\n\r\nbody\r\n")
+	c.cmd(221, "QUIT")
+}
+
+func TestCommandSequence(t *testing.T) {
+	srv, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(503, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "EHLO client.test")
+	c.cmd(503, "RCPT TO:<rcpt@example.test>")
+	c.cmd(503, "DATA")
+	c.cmd(500, "VRFY rcpt@example.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.data(250, "Subject: hello\r\n\r\nbody\r\n")
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].Subject != "hello" || !slices.Equal(emails[0].To, []string{"rcpt@example.test"}) {
+		t.Fatalf("队列中的邮件 = %+v", emails)
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 100
+	srv, addr := startTestServer(t, cfg)
+	c := dialTestServer(t, addr)
+
+	if !strings.Contains(c.cmd(250, "EHLO client.test"), "\nSIZE 100\n") {
+		t.Error("未通告SIZE限制")
+	}
+
+	// 声明的大小超过限制时在MAIL FROM阶段拒绝
+	c.cmd(552, "MAIL FROM:<sender@client.test> SIZE=101")
+	c.cmd(501, "MAIL FROM:<sender@client.test> SIZE=abc")
+
+	// 实际内容超过限制时在DATA结束后拒绝，会话可以继续
+	c.cmd(250, "MAIL FROM:<sender@client.test> SIZE=50")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.data(552, "Subject: big\r\n\r\n"+strings.Repeat("x", 200)+"\r\n")
+	c.cmd(503, "RCPT TO:<rcpt@example.test>")
+
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.data(250, "Subject: small\r\n\r\nbody\r\n")
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("队列中有%d封邮件，期望1封", len(emails))
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	srv, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+
+	// 整个事务一次发出，响应必须按命令顺序返回
+	batch := "MAIL FROM:<sender@client.test>\r\n" +
+		"RCPT TO:<one@example.test>\r\n" +
+		"RCPT TO:<three@example.test> FOO=BAR\r\n" +
+		"RCPT TO:<two@example.test>\r\n" +
+		"DATA\r\n"
+	if _, err := c.conn.Write([]byte(batch)); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{250, 250, 555, 250, 354} {
+		c.expect(code)
+	}
+
+	if _, err := c.conn.Write([]byte("Subject: hi\r\n\r\nbody\r\n.\r\nNOOP\r\nQUIT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{250, 250, 221} {
+		c.expect(code)
+	}
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("队列中有%d封邮件，期望1封", len(emails))
+	}
+}
+
+func TestFlushIfIdle(t *testing.T) {
+	var out strings.Builder
+	s := &smtpSession{
+		reader: bufio.NewReader(strings.NewReader("NOOP\r\nNOOP\r\nNO")),
+		writer: bufio.NewWriter(&out),
+	}
+
+	// 读缓冲区中还有完整的命令时继续积攒响应
+	s.reader.Peek(1)
+	s.send("250 first")
+	if err := s.flushIfIdle(); err != nil || out.Len() != 0 {
+		t.Fatalf("仍有待处理的命令时发出了响应: %q, %v", out.String(), err)
+	}
+
+	s.reader.ReadString('\n')
+	s.send("250 second")
+	if err := s.flushIfIdle(); err != nil || out.Len() != 0 {
+		t.Fatalf("仍有待处理的命令时发出了响应: %q, %v", out.String(), err)
+	}
+
+	// 只剩下不完整的命令时必须发出全部响应，否则客户端会一直等待
+	s.reader.ReadString('\n')
+	if err := s.flushIfIdle(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "250 first\r\n250 second\r\n" {
+		t.Errorf("发出的响应 = %q", out.String())
+	}
+}
+
+func TestLMTPPerRecipientReplies(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 100
+	srv := newTestServer(t, cfg)
+	srv.tlsConfig = testTLSConfig(t)
+	c := dialTestServer(t, serveTestListener(t, srv, config.ListenerModeLMTP))
+
+	c.cmd(500, "EHLO client.test")
+	c.cmd(500, "HELO client.test")
+	if strings.Contains(c.cmd(250, "LHLO client.test"), "STARTTLS") {
+		t.Error("LMTP监听器通告了STARTTLS")
+	}
+
+	// DATA 之后每个被接受的收件人各有一个响应（RFC 2033 4.2）
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<one@example.test>")
+	c.cmd(553, "RCPT TO:<bad..address@example.test>")
+	c.cmd(250, "RCPT TO:<two@example.test>")
+	c.data(250, "Subject: lmtp\r\n\r\nbody\r\n")
+	c.expect(250)
+
+	// 超过大小限制时同样为每个收件人回复552
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<one@example.test>")
+	c.cmd(250, "RCPT TO:<two@example.test>")
+	c.data(552, "Subject: big\r\n\r\n"+strings.Repeat("x", 200)+"\r\n")
+	c.expect(552)
+	c.cmd(250, "NOOP")
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || len(emails[0].To) != 2 {
+		t.Fatalf("队列中的邮件 = %+v，期望1封发给2个收件人的邮件", emails)
+	}
+}
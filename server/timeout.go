@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// 超时后回复客户端时使用的写超时
+const timeoutReplyDeadline = 10 * time.Second
+
+// 判断错误是否由读写超时引起
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// 等待下一条命令的超时时间（RFC 5321 4.5.3.2）
+//
+// 问候之后等待HELO/EHLO使用问候超时，事务之外等待MAIL使用MAIL超时，
+// 事务之中等待RCPT/DATA等命令使用RCPT超时。
+func (s *smtpSession) commandTimeout() time.Duration {
+	switch {
+	case s.helo == "":
+		return s.cfg.GreetingTimeout
+	case !s.inTransaction:
+		return s.cfg.MailTimeout
+	default:
+		return s.cfg.RcptTimeout
+	}
+}
+
+// 为下一条命令设置读写截止时间，命令的响应同样需要在该时间内发出
+func (s *smtpSession) awaitCommand() {
+	s.conn.SetDeadline(time.Now().Add(s.commandTimeout()))
+}
+
+// 为下一个数据块设置读截止时间，只要客户端持续发送数据，截止时间就会不断顺延
+func (s *smtpSession) awaitDataBlock() {
+	s.conn.SetReadDeadline(time.Now().Add(s.cfg.DataBlockTimeout))
+}
+
+// 邮件内容接收完毕后，处理邮件并发出最终响应必须在DATA结束超时内完成
+func (s *smtpSession) awaitDataTermination() {
+	s.conn.SetWriteDeadline(time.Now().Add(s.cfg.DataTerminationTimeout))
+}
+
+// 超时后发送421并准备关闭连接
+func (s *smtpSession) replyTimeout() {
+	s.conn.SetWriteDeadline(time.Now().Add(timeoutReplyDeadline))
+	s.send(fmt.Sprintf("421 4.4.2 %s Error: timeout exceeded", s.cfg.Hostname))
+}
+
+// dataBlockReader 在每次读取之前顺延数据块超时，用于读取BDAT数据块
+type dataBlockReader struct {
+	s *smtpSession
+}
+
+func (r dataBlockReader) Read(p []byte) (int, error) {
+	r.s.awaitDataBlock()
+	return r.s.reader.Read(p)
+}
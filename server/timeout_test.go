@@ -0,0 +1,104 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 读取超时后的421响应并确认连接已关闭
+func (c *testClient) expectTimeout() {
+	c.t.Helper()
+
+	if msg := c.expect(421); !strings.Contains(msg, "timeout exceeded") {
+		c.t.Errorf("421 响应 = %q", msg)
+	}
+	if _, err := c.ReadLine(); err == nil {
+		c.t.Error("超时后连接应当关闭")
+	}
+}
+
+func TestGreetingTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.GreetingTimeout = 100 * time.Millisecond
+	_, addr := startTestServer(t, cfg)
+	c := dialTestServer(t, addr)
+
+	c.expectTimeout()
+}
+
+func TestCommandTimeoutsDependOnState(t *testing.T) {
+	cfg := testConfig()
+	cfg.GreetingTimeout = 300 * time.Millisecond
+	cfg.MailTimeout = 300 * time.Millisecond
+	cfg.RcptTimeout = 100 * time.Millisecond
+	_, addr := startTestServer(t, cfg)
+	c := dialTestServer(t, addr)
+
+	// 事务之外等待时间短于MAIL超时，连接保持
+	c.cmd(250, "EHLO client.test")
+	time.Sleep(150 * time.Millisecond)
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+
+	// 事务之中使用较短的RCPT超时
+	start := time.Now()
+	c.expectTimeout()
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("事务中等待了 %v 才超时，期望使用RCPT超时", elapsed)
+	}
+}
+
+func TestDataBlockTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.DataBlockTimeout = 200 * time.Millisecond
+	srv, addr := startTestServer(t, cfg)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.cmd(354, "DATA")
+
+	// 持续发送数据时超时不断顺延，总耗时可以超过数据块超时
+	for _, line := range []string{"Subject: slow\r\n", "\r\n", "one\r\n", "two\r\n"} {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := c.conn.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.cmd(250, ".")
+
+	// 数据中途停止发送时回复421并断开连接
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.cmd(354, "DATA")
+	if _, err := c.conn.Write([]byte("Subject: stalled\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.expectTimeout()
+
+	emails, err := srv.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("队列中有%d封邮件，期望1封", len(emails))
+	}
+}
+
+func TestBdatTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.DataBlockTimeout = 100 * time.Millisecond
+	_, addr := startTestServer(t, cfg)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+
+	// 声明的数据块没有发完
+	if _, err := c.conn.Write([]byte("BDAT 100 LAST\r\npartial")); err != nil {
+		t.Fatal(err)
+	}
+	c.expectTimeout()
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/ivampiresp/smtp-queue/config"
+	"github.com/rs/zerolog/log"
+)
+
+// TLS 相关状态码
+const (
+	statusTLSReady      = "220 2.0.0 Ready to start TLS"
+	statusTLSRequired   = "530 5.7.0 Must issue a STARTTLS command first"
+	statusTLSAlreadyOn  = "503 5.5.1 TLS already active"
+	statusTLSNoArgument = "501 5.5.4 Syntax error (no parameters allowed)"
+)
+
+// 根据配置加载服务器证书，未配置证书时返回nil
+func loadTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("加载TLS证书时出错: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// 处理STARTTLS命令（RFC 3207）
+func (s *smtpSession) handleStartTLS(args string) error {
+	if s.tlsConfig == nil {
+		s.send(statusCommandNotImplErr)
+		return nil
+	}
+
+	if s.tlsState != nil {
+		s.send(statusTLSAlreadyOn)
+		return nil
+	}
+
+	if args != "" {
+		s.send(statusTLSNoArgument)
+		return nil
+	}
+
+	// 握手之前必须把220响应发出
+	s.send(statusTLSReady)
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(s.conn, s.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		// 握手失败后连接状态不可知，只能关闭会话
+		return fmt.Errorf("TLS握手失败: %w", err)
+	}
+
+	state := tlsConn.ConnectionState()
+	s.conn = tlsConn
+	s.tlsState = &state
+	// 丢弃STARTTLS之后以明文流水线发送的数据，防止命令注入
+	s.resetIO()
+
+	// 握手完成后客户端必须重新发送EHLO，之前获得的信息全部作废
+	s.helo = ""
+	s.esmtp = false
+	s.authUser = ""
+	s.reset()
+
+	log.Info().
+		Str("client", s.conn.RemoteAddr().String()).
+		Str("version", tls.VersionName(state.Version)).
+		Str("cipher", tls.CipherSuiteName(state.CipherSuite)).
+		Msg("已建立TLS连接")
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivampiresp/smtp-queue/config"
+)
+
+// 生成测试用的自签名证书
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.test"},
+		DNSNames:     []string{"mx.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// 测试客户端使用的TLS配置，接受自签名证书
+func testClientTLSConfig() *tls.Config {
+	return &tls.Config{ServerName: "mx.test", InsecureSkipVerify: true}
+}
+
+// 在已收到220响应的连接上完成TLS握手，之后的命令通过加密连接发送
+func (c *testClient) handshake() {
+	c.t.Helper()
+
+	tlsConn := tls.Client(c.conn, testClientTLSConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("TLS握手失败: %v", err)
+	}
+	c.conn = tlsConn
+	c.Conn = textproto.NewConn(tlsConn)
+}
+
+func TestSTARTTLS(t *testing.T) {
+	srv := newTestServer(t, testConfig())
+	srv.tlsConfig = testTLSConfig(t)
+	addr := serveTestListener(t, srv, config.ListenerModeStartTLS)
+	c := dialTestServer(t, addr)
+
+	if !strings.Contains(c.cmd(250, "EHLO client.test"), "\nSTARTTLS") {
+		t.Fatal("未通告STARTTLS")
+	}
+	c.cmd(501, "STARTTLS now")
+	c.cmd(220, "STARTTLS")
+	c.handshake()
+
+	// 握手后必须重新发送EHLO，且不再通告STARTTLS
+	c.cmd(503, "MAIL FROM:<sender@client.test>")
+	if strings.Contains(c.cmd(250, "EHLO client.test"), "STARTTLS") {
+		t.Error("TLS会话中仍通告STARTTLS")
+	}
+	c.cmd(503, "STARTTLS")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.data(250, "Subject: hello\r\n\r\nbody\r\n")
+}
+
+func TestSTARTTLSDiscardsPipelinedCommands(t *testing.T) {
+	srv := newTestServer(t, testConfig())
+	srv.tlsConfig = testTLSConfig(t)
+	addr := serveTestListener(t, srv, config.ListenerModeStartTLS)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+
+	// 中间人在STARTTLS之后注入的明文命令必须被丢弃（RFC 3207 4.2，CVE-2011-0411）
+	if _, err := c.conn.Write([]byte("STARTTLS\r\nMAIL FROM:<attacker@evil.test>\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(220)
+	c.handshake()
+
+	// 注入的命令如果被执行，这里会先读到它的响应
+	if msg := c.cmd(250, "EHLO client.test"); !strings.HasPrefix(msg, "mx.test greets") {
+		t.Fatalf("EHLO 响应 = %q", msg)
+	}
+	c.cmd(503, "RCPT TO:<rcpt@example.test>")
+}
+
+func TestTLSRequired(t *testing.T) {
+	cfg := testConfig()
+	cfg.TLSRequired = true
+	srv := newTestServer(t, cfg)
+	srv.tlsConfig = testTLSConfig(t)
+	addr := serveTestListener(t, srv, config.ListenerModeStartTLS)
+	c := dialTestServer(t, addr)
+
+	c.cmd(250, "EHLO client.test")
+	c.cmd(530, "MAIL FROM:<sender@client.test>")
+	c.cmd(220, "STARTTLS")
+	c.handshake()
+	c.cmd(250, "EHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+}
+
+func TestSTARTTLSNotConfigured(t *testing.T) {
+	_, addr := startTestServer(t, testConfig())
+	c := dialTestServer(t, addr)
+
+	if strings.Contains(c.cmd(250, "EHLO client.test"), "STARTTLS") {
+		t.Error("未配置证书时通告了STARTTLS")
+	}
+	c.cmd(502, "STARTTLS")
+}
+
+func TestImplicitTLSListener(t *testing.T) {
+	srv := newTestServer(t, testConfig())
+	srv.tlsConfig = testTLSConfig(t)
+	addr := serveTestListener(t, srv, config.ListenerModeTLS)
+
+	conn, err := tls.Dial("tcp", addr, testClientTLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, conn)
+
+	if strings.Contains(c.cmd(250, "EHLO client.test"), "STARTTLS") {
+		t.Error("隐式TLS连接通告了STARTTLS")
+	}
+	c.cmd(503, "STARTTLS")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+}
+
+func TestPlainListener(t *testing.T) {
+	srv := newTestServer(t, testConfig())
+	srv.tlsConfig = testTLSConfig(t)
+	c := dialTestServer(t, serveTestListener(t, srv, config.ListenerModePlain))
+
+	if strings.Contains(c.cmd(250, "EHLO client.test"), "STARTTLS") {
+		t.Error("明文监听器通告了STARTTLS")
+	}
+	c.cmd(502, "STARTTLS")
+}
+
+func TestImplicitTLSListenerRequiresCertificate(t *testing.T) {
+	srv := newTestServer(t, testConfig())
+	if _, err := srv.listen(config.ListenerConfig{Addr: "127.0.0.1:0", Mode: config.ListenerModeTLS}); err == nil {
+		t.Fatal("未配置证书时隐式TLS监听器应当启动失败")
+	}
+}
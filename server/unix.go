@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ivampiresp/smtp-queue/config"
+)
+
+// unixSocketPath 从监听地址中取出Unix域套接字路径，例如 "unix:/run/smtp-queue.sock"
+func unixSocketPath(addr string) (string, bool) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	return path, ok && path != ""
+}
+
+// listenUnix 在指定路径上创建Unix域套接字，并按配置设置权限和属主。
+// 关闭监听器时套接字文件会被删除
+func listenUnix(path string, cfg *config.Config) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	// 删除上次运行遗留的套接字文件，但不覆盖其他类型的文件
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s 已存在且不是套接字文件", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(true)
+
+	if err := os.Chmod(path, cfg.UnixSocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	if cfg.UnixSocketOwner != "" {
+		uid, gid, err := lookupOwner(cfg.UnixSocketOwner)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+// lookupOwner 解析 "用户[:组]" 形式的属主，用户和组可以是名称或数字ID。
+// 未指定的部分返回-1，表示保持不变
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("未知的用户: %q", userName)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("无效的用户ID: %q", u.Uid)
+		}
+	}
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("未知的用户组: %q", groupName)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("无效的用户组ID: %q", g.Gid)
+		}
+	}
+
+	return uid, gid, nil
+}
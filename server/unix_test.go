@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/ivampiresp/smtp-queue/config"
+)
+
+func TestUnixSocketPath(t *testing.T) {
+	if path, ok := unixSocketPath("unix:/run/smtp.sock"); !ok || path != "/run/smtp.sock" {
+		t.Errorf("unixSocketPath() = %q, %v", path, ok)
+	}
+	for _, addr := range []string{"unix:", ":2525", "127.0.0.1:25"} {
+		if _, ok := unixSocketPath(addr); ok {
+			t.Errorf("unixSocketPath(%q) 不应识别为Unix套接字", addr)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	cfg := testConfig()
+	cfg.UnixSocketMode = 0o660
+	cfg.UnixSocketOwner = strconv.Itoa(os.Getuid())
+	path := filepath.Join(t.TempDir(), "run", "smtp.sock")
+
+	// 上次运行遗留的套接字文件会被替换
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o660 {
+		t.Errorf("套接字权限 = %v，期望 0660", info.Mode().Perm())
+	}
+
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("关闭监听器后套接字文件未删除")
+	}
+
+	// 不覆盖普通文件
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path, cfg); err == nil {
+		t.Error("路径为普通文件时应当拒绝监听")
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	uid, gid, err := lookupOwner(strconv.Itoa(os.Getuid()))
+	if err != nil || uid != os.Getuid() || gid != -1 {
+		t.Errorf("lookupOwner() = %d, %d, %v", uid, gid, err)
+	}
+
+	uid, gid, err = lookupOwner(":" + strconv.Itoa(os.Getgid()))
+	if err != nil || uid != -1 || gid != os.Getgid() {
+		t.Errorf("lookupOwner() = %d, %d, %v", uid, gid, err)
+	}
+
+	if _, _, err := lookupOwner("no-such-user-smtp-queue"); err == nil {
+		t.Error("未知用户应当返回错误")
+	}
+}
+
+func TestUnixSocketSession(t *testing.T) {
+	cfg := testConfig()
+	cfg.UnixSocketMode = 0o600
+	cfg.AuthRequired = true
+	cfg.DeniedNetworks = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}
+	srv := newTestServer(t, cfg)
+	srv.auth = testAuthenticator(t, "alice", "secret")
+
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+	serveListenerConfig(t, srv, config.ListenerConfig{Addr: "unix:" + path, Mode: config.ListenerModeLMTP})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, conn)
+
+	// 本机客户端不受网段访问控制，也无需认证
+	c.cmd(250, "LHLO client.test")
+	c.cmd(250, "MAIL FROM:<sender@client.test>")
+	c.cmd(250, "RCPT TO:<rcpt@example.test>")
+	c.data(250, "Subject: local\r\n\r\nbody\r\n")
+}
@@ -0,0 +1,246 @@
+package worker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/ivampiresp/smtp-queue/db"
+	"github.com/ivampiresp/smtp-queue/dsn"
+	"github.com/ivampiresp/smtp-queue/message"
+	"github.com/rs/zerolog/log"
+)
+
+// 投递状态报告中的Action字段（RFC 3464 2.3.3）
+const (
+	actionFailed  = "failed"
+	actionDelayed = "delayed"
+	actionRelayed = "relayed"
+)
+
+// 每种Action对应的NOTIFY条件和默认状态码
+var reportActions = map[string]struct {
+	notify string
+	status string
+}{
+	actionFailed:  {notify: dsn.NotifyFailure, status: "5.0.0"},
+	actionDelayed: {notify: dsn.NotifyDelay, status: "4.0.0"},
+	actionRelayed: {notify: dsn.NotifySuccess, status: "2.0.0"},
+}
+
+// notifySender 为邮件的全部收件人生成投递状态报告，diagnostic 为最后一次投递的错误信息
+func (w *Worker) notifySender(email *db.Email, action, diagnostic string) {
+	recipients := make([]int, len(email.To))
+	diagnostics := make(map[int]string, len(email.To))
+	for i := range email.To {
+		recipients[i] = i
+		diagnostics[i] = diagnostic
+	}
+	w.notifyRecipients(email, action, recipients, diagnostics)
+}
+
+// notifyRecipients 为recipients（email.To中的下标）中要求通知的收件人生成投递状态报告，
+// 并加入队列发回给原始发件人
+//
+// diagnostics 为各收件人最后一次投递的错误信息，relayed 报告时为空。
+func (w *Worker) notifyRecipients(email *db.Email, action string, recipients []int, diagnostics map[int]string) {
+	if len(recipients) == 0 {
+		return
+	}
+
+	// 空反向路径的邮件本身就是通知（例如退信），不能再为它生成通知，否则两个系统之间可能无限循环
+	if email.From == "" {
+		if action == actionFailed {
+			log.Warn().Str("queue_id", email.QueueID).Strs("to", email.To).Msg("通知邮件投递失败，不再生成退信")
+		}
+		return
+	}
+
+	rule := reportActions[action]
+	var notify []int
+	for _, i := range recipients {
+		if recipientParams(email, i).Wants(rule.notify) {
+			notify = append(notify, i)
+		}
+	}
+	if len(notify) == 0 {
+		return
+	}
+
+	subject, body := w.buildReport(email, action, notify, diagnostics)
+	report := &db.Email{
+		From:    "",
+		To:      []string{email.From},
+		Subject: subject,
+		Body:    body,
+	}
+	if err := w.store.Enqueue(report); err != nil {
+		log.Error().Err(err).Str("queue_id", email.QueueID).Str("action", action).Msg("生成投递状态报告时出错")
+		return
+	}
+
+	log.Info().
+		Str("queue_id", email.QueueID).
+		Str("report_queue_id", report.QueueID).
+		Str("action", action).
+		Str("to", email.From).
+		Msg("已生成投递状态报告")
+}
+
+// 构建RFC 3464 multipart/report邮件，返回主题和完整的邮件内容
+func (w *Worker) buildReport(email *db.Email, action string, recipients []int, diagnostics map[int]string) (string, string) {
+	now := time.Now()
+	boundary := randomToken()
+	mailParams := dsn.ParseMailParams(email.MailParams)
+
+	var subject, summary string
+	switch action {
+	case actionFailed:
+		subject = "Undelivered Mail Returned to Sender"
+		summary = "Your message could not be delivered to the following recipients. The queue has given up retrying."
+	case actionDelayed:
+		subject = "Delayed Mail (still being retried)"
+		summary = fmt.Sprintf("Your message has not yet been delivered to the following recipients. The queue will keep retrying until %s.",
+			email.Created.Add(w.config.MaxEmailAge).Format(time.RFC1123Z))
+	case actionRelayed:
+		subject = "Successful Mail Relay"
+		summary = "Your message was relayed to the upstream server. Any further notifications from the upstream server are sent to the relay's own address, so no further notifications will be sent to you."
+	}
+
+	var b strings.Builder
+
+	// 邮件头
+	fmt.Fprintf(&b, "From: Mail Delivery System <%s>\r\n", w.config.SMTPFrom)
+	fmt.Fprintf(&b, "To: %s\r\n", email.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", randomToken(), w.config.Hostname)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n", boundary)
+	b.WriteString("\r\n")
+
+	// 第一部分：供人阅读的说明
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "This is the mail system at host %s.\r\n\r\n%s\r\n\r\n", w.config.Hostname, summary)
+	for _, i := range recipients {
+		fmt.Fprintf(&b, "<%s>", email.To[i])
+		if diagnostic := diagnostics[i]; diagnostic != "" {
+			fmt.Fprintf(&b, ": %s", oneLine(diagnostic))
+		}
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+
+	// 第二部分：机器可读的投递状态
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", w.config.Hostname)
+	if email.QueueID != "" {
+		fmt.Fprintf(&b, "X-SMTP-Queue-ID: %s\r\n", email.QueueID)
+	}
+	if mailParams.EnvID != "" {
+		if envID, err := dsn.DecodeXtext(mailParams.EnvID); err == nil {
+			fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", envID)
+		}
+	}
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", email.Created.Format(time.RFC1123Z))
+	for _, i := range recipients {
+		b.WriteString("\r\n")
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", email.To[i])
+		if orcpt := recipientParams(email, i).OriginalRecipient(); orcpt != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\r\n", orcpt)
+		}
+		diagnostic := diagnostics[i]
+		fmt.Fprintf(&b, "Action: %s\r\n", action)
+		fmt.Fprintf(&b, "Status: %s\r\n", reportStatus(diagnostic, reportActions[action].status))
+		if diagnostic != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: %s\r\n", diagnosticCode(diagnostic))
+		}
+		fmt.Fprintf(&b, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+		if action == actionDelayed {
+			fmt.Fprintf(&b, "Will-Retry-Until: %s\r\n", email.Created.Add(w.config.MaxEmailAge).Format(time.RFC1123Z))
+		}
+	}
+	b.WriteString("\r\n")
+
+	// 第三部分：原始邮件，RET=FULL 时附带全文，否则只附带邮件头
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	if mailParams.Ret == dsn.RetFull {
+		b.WriteString("Content-Type: message/rfc822\r\n\r\n")
+		b.WriteString(email.Body)
+	} else {
+		b.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+		header, _ := message.SplitHeader(email.Body)
+		b.WriteString(header)
+	}
+	if !strings.HasSuffix(b.String(), "\r\n") {
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+
+	return subject, b.String()
+}
+
+// 获取第i个收件人的DSN参数
+func recipientParams(email *db.Email, i int) dsn.RcptParams {
+	if i >= len(email.RcptParams) {
+		return dsn.RcptParams{}
+	}
+	return dsn.ParseRcptParams(email.RcptParams[i])
+}
+
+// 从SMTP错误中提取增强状态码，例如 "550 5.1.1 User unknown" 中的 5.1.1
+func reportStatus(diagnostic, defaultStatus string) string {
+	fields := strings.Fields(diagnostic)
+	if len(fields) >= 2 && isReplyCode(fields[0]) {
+		parts := strings.Split(fields[1], ".")
+		if len(parts) == 3 && parts[0] == defaultStatus[:1] {
+			return fields[1]
+		}
+	}
+	return defaultStatus
+}
+
+// 格式化Diagnostic-Code字段，SMTP响应使用smtp类型
+func diagnosticCode(diagnostic string) string {
+	diagnostic = oneLine(diagnostic)
+	if len(diagnostic) >= 3 && isReplyCode(diagnostic[:3]) {
+		return "smtp; " + diagnostic
+	}
+	return "X-SMTP-Queue; " + diagnostic
+}
+
+// 判断是否为三位数的SMTP响应码
+func isReplyCode(s string) bool {
+	return len(s) == 3 && s[0] >= '2' && s[0] <= '5' &&
+		s[1] >= '0' && s[1] <= '9' && s[2] >= '0' && s[2] <= '9'
+}
+
+// 将多行错误信息合并为一行，避免破坏邮件头格式
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// 将投递错误格式化为诊断信息，SMTP响应保持"550 5.1.1 ..."的原始格式以便解析状态码
+func errorText(err error) string {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return fmt.Sprintf("%03d %s", tpErr.Code, oneLine(tpErr.Msg))
+	}
+	return err.Error()
+}
+
+// 生成随机标识，用于MIME边界和Message-ID
+func randomToken() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
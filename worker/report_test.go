@@ -0,0 +1,178 @@
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivampiresp/smtp-queue/config"
+	"github.com/ivampiresp/smtp-queue/db"
+)
+
+func TestReportStatus(t *testing.T) {
+	tests := []struct {
+		diagnostic, defaultStatus, want string
+	}{
+		{"550 5.1.1 User unknown", "5.0.0", "5.1.1"},
+		{"452 4.2.2 Mailbox full", "4.0.0", "4.2.2"},
+		{"550 User unknown", "5.0.0", "5.0.0"},
+		// 增强状态码的类别与报告不一致时使用默认状态码
+		{"451 4.3.0 Try again later", "5.0.0", "5.0.0"},
+		{"dial tcp: connection refused", "5.0.0", "5.0.0"},
+		{"", "2.0.0", "2.0.0"},
+	}
+	for _, tt := range tests {
+		if got := reportStatus(tt.diagnostic, tt.defaultStatus); got != tt.want {
+			t.Errorf("reportStatus(%q, %q) = %q, want %q", tt.diagnostic, tt.defaultStatus, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnosticCode(t *testing.T) {
+	tests := []struct {
+		diagnostic, want string
+	}{
+		{"550 5.1.1 User unknown", "smtp; 550 5.1.1 User unknown"},
+		{"550-5.1.1 first\n550 5.1.1 second", "smtp; 550-5.1.1 first 550 5.1.1 second"},
+		{"dial tcp: connection refused", "X-SMTP-Queue; dial tcp: connection refused"},
+	}
+	for _, tt := range tests {
+		if got := diagnosticCode(tt.diagnostic); got != tt.want {
+			t.Errorf("diagnosticCode(%q) = %q, want %q", tt.diagnostic, got, tt.want)
+		}
+	}
+}
+
+// 创建不连接上游服务器的工作者，只用于生成投递状态报告
+func newReportWorker(t *testing.T) *Worker {
+	t.Helper()
+
+	store := db.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+	return New(store, &config.Config{
+		Hostname:    "relay.test",
+		SMTPFrom:    "relay@relay.test",
+		MaxEmailAge: 72 * time.Hour,
+	})
+}
+
+func TestReportReturnContent(t *testing.T) {
+	tests := []struct {
+		mailParams string
+		full       bool
+	}{
+		{"", false},
+		{"RET=HDRS", false},
+		{"RET=FULL", true},
+	}
+	for _, tt := range tests {
+		w := newReportWorker(t)
+		email := testEmail([]string{"a@example.test"}, nil)
+		email.MailParams = tt.mailParams
+
+		_, body := w.buildReport(email, actionFailed, []int{0}, nil)
+
+		if got := strings.Contains(body, "Content-Type: message/rfc822\r\n\r\nSubject: test\r\n"); got != tt.full {
+			t.Errorf("%q: 附带完整邮件 = %v, want %v", tt.mailParams, got, tt.full)
+		}
+		if !tt.full && !strings.Contains(body, "Content-Type: text/rfc822-headers\r\n\r\nSubject: test\r\nMessage-ID: <1@client.test>\r\n--") {
+			t.Errorf("%q: 报告未只附带邮件头: %q", tt.mailParams, body)
+		}
+		if got := strings.Contains(body, "\r\nbody\r\n"); got != tt.full {
+			t.Errorf("%q: 报告包含正文 = %v, want %v", tt.mailParams, got, tt.full)
+		}
+	}
+}
+
+func TestReportRecipientFields(t *testing.T) {
+	w := newReportWorker(t)
+	email := testEmail([]string{"a@example.test", "b@example.test"}, []string{"ORCPT=rfc822;orig+2Ba@example.test", ""})
+	email.MailParams = "ENVID=env+2B1"
+
+	_, body := w.buildReport(email, actionFailed, []int{0, 1}, map[int]string{
+		0: "550 5.1.1 User unknown",
+		1: "554 5.7.1 Rejected",
+	})
+
+	for _, want := range []string{
+		"Original-Envelope-Id: env+1\r\n",
+		"Final-Recipient: rfc822; a@example.test\r\nOriginal-Recipient: rfc822; orig+a@example.test\r\nAction: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 User unknown\r\n",
+		"Final-Recipient: rfc822; b@example.test\r\nAction: failed\r\nStatus: 5.7.1\r\nDiagnostic-Code: smtp; 554 5.7.1 Rejected\r\n",
+		"<a@example.test>: 550 5.1.1 User unknown\r\n<b@example.test>: 554 5.7.1 Rejected\r\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("报告缺少 %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestNotifyRecipients(t *testing.T) {
+	tests := []struct {
+		name       string
+		from       string
+		rcptParams []string
+		action     string
+		want       []string // 报告中的收件人，nil表示不生成报告
+	}{
+		{"默认通知失败", "sender@client.test", nil, actionFailed, []string{"a@example.test", "b@example.test"}},
+		{"默认不通知延迟", "sender@client.test", nil, actionDelayed, nil},
+		{"NOTIFY过滤", "sender@client.test", []string{"NOTIFY=NEVER", "NOTIFY=SUCCESS,FAILURE"}, actionFailed, []string{"b@example.test"}},
+		{"全部NOTIFY=NEVER", "sender@client.test", []string{"NOTIFY=NEVER", "NOTIFY=NEVER"}, actionFailed, nil},
+		{"转发成功", "sender@client.test", []string{"NOTIFY=SUCCESS", ""}, actionRelayed, []string{"a@example.test"}},
+		{"空反向路径", "", nil, actionFailed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newReportWorker(t)
+			email := testEmail([]string{"a@example.test", "b@example.test"}, tt.rcptParams)
+			email.From = tt.from
+
+			w.notifySender(email, tt.action, "550 5.1.1 User unknown")
+
+			reports, err := w.store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if len(reports) != 0 {
+					t.Errorf("不应生成报告: %q", bodies(reports))
+				}
+				return
+			}
+			if len(reports) != 1 {
+				t.Fatalf("生成了 %d 份报告，期望1份", len(reports))
+			}
+			report := reports[0]
+			if report.From != "" || len(report.To) != 1 || report.To[0] != tt.from {
+				t.Errorf("报告信封 = %q -> %v", report.From, report.To)
+			}
+			if got := strings.Count(report.Body, "Final-Recipient: "); got != len(tt.want) {
+				t.Errorf("报告包含 %d 个收件人，期望 %v", got, tt.want)
+			}
+			for _, rcpt := range tt.want {
+				if !strings.Contains(report.Body, "Final-Recipient: rfc822; "+rcpt+"\r\n") {
+					t.Errorf("报告缺少收件人 %s", rcpt)
+				}
+			}
+		})
+	}
+}
+
+// 信封发件人始终为SMTP_FROM，客户端的DSN参数不转发给上游服务器
+func TestDSNParamsNotForwarded(t *testing.T) {
+	upstream := &fakeUpstream{extensions: []string{"DSN", "8BITMIME"}}
+	email := testEmail([]string{"a@example.test"}, []string{"NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;a@example.test"})
+	email.MailParams = "RET=FULL ENVID=env1"
+	w := newTestWorker(t, upstream.start(t), email)
+
+	w.processQueue()
+
+	mail := upstream.command("MAIL")
+	rcpt := upstream.command("RCPT")
+	if len(mail) != 1 || mail[0] != "MAIL FROM:<relay@relay.test> BODY=8BITMIME" {
+		t.Errorf("MAIL命令 = %q", mail)
+	}
+	if len(rcpt) != 1 || rcpt[0] != "RCPT TO:<a@example.test>" {
+		t.Errorf("RCPT命令 = %q", rcpt)
+	}
+}
@@ -3,34 +3,43 @@ package worker
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/ivampiresp/smtp-queue/config"
 	"github.com/ivampiresp/smtp-queue/db"
+	"github.com/ivampiresp/smtp-queue/message"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/idna"
 )
 
 // Worker 负责处理队列中的邮件并发送它们
 type Worker struct {
-	db     *db.DB
+	store  db.Store
 	config *config.Config
 }
 
 // New 创建一个新的Worker实例
-func New(database *db.DB, cfg *config.Config) *Worker {
+func New(store db.Store, cfg *config.Config) *Worker {
 	return &Worker{
-		db:     database,
+		store:  store,
 		config: cfg,
 	}
 }
 
 // Start 开始处理邮件队列
 func (w *Worker) Start(ctx context.Context) {
-	log.Info().Dur("interval", w.config.QueueInterval).Msg("邮件队列工作者已启动")
+	log.Info().
+		Dur("interval", w.config.QueueInterval).
+		Str("worker_id", w.config.WorkerID).
+		Dur("lease", w.config.LeaseDuration).
+		Msg("邮件队列工作者已启动")
 
 	ticker := time.NewTicker(w.config.QueueInterval)
 	defer ticker.Stop()
@@ -62,14 +71,28 @@ func (w *Worker) Start(ctx context.Context) {
 func (w *Worker) cleanupOldEmails() {
 	log.Debug().Msg("清理过老的邮件")
 
-	count, err := w.db.CleanupOldEmails(w.config.MaxEmailAge, w.config.MaxFailCount)
+	emails, err := w.store.Cleanup(w.config.MaxEmailAge, w.config.MaxFailCount)
 	if err != nil {
 		log.Error().Err(err).Msg("清理邮件时出错")
 		return
 	}
 
-	if count > 0 {
-		log.Info().Int64("count", count).Msg("已清理过期或失败的邮件")
+	// 已发送的邮件无需通知，其余邮件向发件人退信
+	for _, email := range emails {
+		if email.Sent {
+			continue
+		}
+
+		reason := email.LastError
+		if reason == "" {
+			reason = fmt.Sprintf("邮件在队列中超过%s仍未投递", w.config.MaxEmailAge)
+		}
+		log.Warn().Str("queue_id", email.QueueID).Str("reason", reason).Msg("邮件已过期，放弃投递")
+		w.notifySender(email, actionFailed, reason)
+	}
+
+	if len(emails) > 0 {
+		log.Info().Int("count", len(emails)).Msg("已清理过期或失败的邮件")
 	}
 }
 
@@ -77,8 +100,16 @@ func (w *Worker) cleanupOldEmails() {
 func (w *Worker) processQueue() {
 	log.Debug().Msg("处理邮件队列")
 
-	// 每次最多处理 10 封邮件
-	emails, err := w.db.GetPendingEmails(10)
+	// 将租约已到期的邮件放回队列，例如投递过程中退出的实例取出的邮件
+	reaped, err := w.store.Reap()
+	if err != nil {
+		log.Error().Err(err).Msg("回收过期租约时出错")
+	} else if reaped > 0 {
+		log.Warn().Int("count", reaped).Msg("已将租约过期的邮件放回队列")
+	}
+
+	// 每次最多处理 10 封邮件，租约期间其他工作者不会取出这些邮件
+	emails, err := w.store.Claim(w.config.WorkerID, 10, w.config.LeaseDuration)
 	if err != nil {
 		log.Error().Err(err).Msg("获取待处理邮件时出错")
 		return
@@ -92,150 +123,164 @@ func (w *Worker) processQueue() {
 	log.Info().Int("count", len(emails)).Msg("发现待处理的邮件")
 
 	for _, email := range emails {
+		// 逐封投递前续约，保证投递过程中租约不会到期
+		if err := w.store.Renew(email, w.config.LeaseDuration); err != nil {
+			w.logStoreError(err, email, "续约邮件租约时出错")
+			continue
+		}
+
 		log.Info().
-			Int64("id", email.ID).
+			Str("queue_id", email.QueueID).
 			Str("from", email.From).
 			Strs("to", email.To).
 			Str("subject", email.Subject).
+			Str("auth_user", email.AuthUser).
 			Msg("正在发送邮件")
 
-		if err := w.sendEmail(email); err != nil {
-			log.Error().Err(err).Int64("id", email.ID).Msg("发送邮件失败")
+		rcptErrors, sendErr := w.sendEmail(email)
+		if sendErr != nil {
+			log.Error().Err(sendErr).Str("queue_id", email.QueueID).Msg("发送邮件失败")
+		}
+		for i, err := range rcptErrors {
+			log.Warn().Err(err).Str("queue_id", email.QueueID).Str("rcpt", email.To[i]).Bool("permanent", isPermanent(err)).Msg("上游服务器拒绝收件人")
+		}
+
+		w.handleResult(email, rcptErrors, sendErr)
+	}
+}
+
+// 根据一次投递的结果更新队列并通知发件人
+//
+// 上游永久拒绝（5xx）的收件人立即退信；暂时拒绝（4xx）的收件人，以及整封邮件投递失败时
+// 尚未投递的收件人留在队列中重试，其余收件人已投递成功。只有部分收件人需要重试时，
+// 邮件中只保留这些收件人。队列更新成功后再通知发件人，避免租约失效时其他工作者重复投递或通知。
+func (w *Worker) handleResult(email *db.Email, rcptErrors map[int]error, sendErr error) {
+	var bounced, retry, delivered []int
+	diagnostics := make(map[int]string)
+	for i := range email.To {
+		err, rejected := rcptErrors[i]
+		switch {
+		case rejected && isPermanent(err):
+			bounced = append(bounced, i)
+		case rejected:
+			retry = append(retry, i)
+		case sendErr != nil:
+			retry = append(retry, i)
+			err = sendErr
+		default:
+			delivered = append(delivered, i)
+		}
+		if err != nil {
+			diagnostics[i] = errorText(err)
+		}
+	}
+
+	// 通知使用原始的收件人列表，SetRecipients会替换email中的收件人
+	original := *email
+
+	switch {
+	case len(retry) == 0:
+		// 全部收件人都已投递成功或被永久拒绝，从队列中删除
+		if err := w.store.Ack(email); err != nil {
+			w.logStoreError(err, email, "删除已投递邮件时出错")
+			return
+		}
+		if len(delivered) > 0 {
+			log.Info().Str("queue_id", email.QueueID).Int("delivered", len(delivered)).Int("bounced", len(bounced)).Msg("邮件发送成功并已从队列中删除")
+		}
 
-			// 更新失败计数
-			if err := w.db.MarkEmailFailed(email.ID, err.Error()); err != nil {
-				log.Error().Err(err).Int64("id", email.ID).Msg("更新邮件失败状态时出错")
+	case isPermanent(sendErr) || email.FailCount+1 >= w.config.MaxFailCount:
+		// 上游永久拒绝整封邮件或失败次数达到上限时放弃重试，其余收件人同样退信。
+		// 在仍持有租约时删除邮件，删除成功后再退信，避免其他工作者在此期间取出并重复投递
+		log.Warn().Str("queue_id", email.QueueID).Bool("permanent", isPermanent(sendErr)).Msg("放弃投递，删除邮件")
+		if err := w.store.Delete(email); err != nil {
+			w.logStoreError(err, email, "删除失败的邮件时出错")
+			return
+		}
+		bounced = append(bounced, retry...)
+		sort.Ints(bounced)
+
+	default:
+		if len(retry) < len(email.To) {
+			to, params := selectRecipients(email, retry)
+			if err := w.store.SetRecipients(email, to, params); err != nil {
+				w.logStoreError(err, email, "更新待重试的收件人时出错")
+				return
 			}
+		}
 
-			// 如果失败次数太多，可以考虑放弃此邮件
-			if email.FailCount >= 5 {
-				log.Warn().Int64("id", email.ID).Msg("邮件失败次数过多，删除邮件")
-				if err := w.db.DeleteEmail(email.ID); err != nil {
-					log.Error().Err(err).Int64("id", email.ID).Msg("删除失败的邮件时出错")
-				}
+		// 延迟超过阈值时通知发件人，每封邮件只通知一次，在释放租约前记录
+		if w.config.DelayWarningTime > 0 && !email.DelayNotified &&
+			time.Since(email.Created) >= w.config.DelayWarningTime {
+			if err := w.store.MarkDelayNotified(email); err != nil {
+				w.logStoreError(err, email, "更新延迟通知状态时出错")
+			} else {
+				w.notifyRecipients(&original, actionDelayed, retry, diagnostics)
 			}
+		}
 
-			continue
+		// 更新失败计数并释放租约，等待下次重试
+		if err := w.store.Fail(email, diagnostics[retry[0]]); err != nil {
+			w.logStoreError(err, email, "更新邮件失败状态时出错")
 		}
+	}
 
-		// 删除已发送的邮件
-		if err := w.db.DeleteEmail(email.ID); err != nil {
-			log.Error().Err(err).Int64("id", email.ID).Msg("删除已发送邮件时出错")
-			continue
+	w.notifyRecipients(&original, actionFailed, bounced, diagnostics)
+	// 上游服务器的投递状态通知发往SMTP_FROM而不是原始发件人，因此始终由队列发送转发成功通知
+	w.notifyRecipients(&original, actionRelayed, delivered, nil)
+}
+
+// 选出下标对应的收件人及其参数
+func selectRecipients(email *db.Email, indexes []int) (to, rcptParams []string) {
+	for _, i := range indexes {
+		to = append(to, email.To[i])
+		if i < len(email.RcptParams) {
+			rcptParams = append(rcptParams, email.RcptParams[i])
+		} else {
+			rcptParams = append(rcptParams, "")
 		}
+	}
+	return to, rcptParams
+}
 
-		log.Info().Int64("id", email.ID).Msg("邮件发送成功并已从队列中删除")
+// 记录更新队列时的错误，租约已失效时说明邮件已由其他工作者处理
+func (w *Worker) logStoreError(err error, email *db.Email, msg string) {
+	if errors.Is(err, db.ErrLeaseLost) {
+		log.Warn().Str("queue_id", email.QueueID).Msg(msg + "：租约已失效，邮件可能已由其他工作者处理")
+		return
 	}
+	log.Error().Err(err).Str("queue_id", email.QueueID).Msg(msg)
 }
 
-// 发送单封邮件
-func (w *Worker) sendEmail(email *db.Email) error {
+// 发送单封邮件，返回值同deliver
+func (w *Worker) sendEmail(email *db.Email) (map[int]error, error) {
 	// 检查SMTP配置
 	if w.config.SMTPHost == "" {
-		return fmt.Errorf("未配置SMTP服务器")
+		return nil, fmt.Errorf("未配置SMTP服务器")
 	}
 
 	// 准备SMTP服务器地址和认证信息
 	smtpAddr := fmt.Sprintf("%s:%d", w.config.SMTPHost, w.config.SMTPPort)
-	auth := smtp.PlainAuth("", w.config.SMTPUsername, w.config.SMTPPassword, w.config.SMTPHost)
+	// 未配置用户名时不进行认证
+	var auth smtp.Auth
+	if w.config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", w.config.SMTPUsername, w.config.SMTPPassword, w.config.SMTPHost)
+	}
 
 	// 始终使用配置的SMTP_FROM作为发件人，忽略客户端提供的发件人
 	from := w.config.SMTPFrom
 	if from == "" {
-		return fmt.Errorf("未配置SMTP_FROM，无法发送邮件")
-	}
-
-	// 检查邮件内容是否已包含邮件头
-	hasHeaders := false
-	lines := strings.Split(email.Body, "\r\n")
-	if len(lines) == 0 {
-		lines = strings.Split(email.Body, "\n") // 兼容以\n分隔的情况
-	}
-
-	// 检查是否存在常见的邮件头
-	for _, line := range lines {
-		if strings.HasPrefix(strings.ToLower(line), "content-type:") ||
-			strings.HasPrefix(strings.ToLower(line), "mime-version:") {
-			hasHeaders = true
-			break
-		}
+		return nil, fmt.Errorf("未配置SMTP_FROM，无法发送邮件")
 	}
 
 	// 准备邮件内容
-	var message string
-	if hasHeaders {
-		// 邮件内容已经包含头部，我们需要替换或添加From头部
-		var newLines []string
-		fromReplaced := false
-		toReplaced := false
-
-		// 替换或添加必要的头部
-		for _, line := range lines {
-			lowerLine := strings.ToLower(line)
-
-			// 替换From头
-			if strings.HasPrefix(lowerLine, "from:") {
-				newLines = append(newLines, fmt.Sprintf("From: %s", from))
-				fromReplaced = true
-				continue
-			}
-
-			// 替换To头
-			if strings.HasPrefix(lowerLine, "to:") {
-				newLines = append(newLines, fmt.Sprintf("To: %s", buildAddressList(email.To)))
-				toReplaced = true
-				continue
-			}
-
-			// 保留其他头部和内容
-			newLines = append(newLines, line)
-		}
-
-		// 如果没有替换From头，添加一个
-		if !fromReplaced {
-			// 找到第一个空行前插入From头
-			inserted := false
-			newLinesWithFrom := []string{}
-
-			for _, line := range newLines {
-				if line == "" && !inserted {
-					newLinesWithFrom = append(newLinesWithFrom, fmt.Sprintf("From: %s", from))
-					inserted = true
-				}
-				newLinesWithFrom = append(newLinesWithFrom, line)
-			}
-
-			// 如果没有空行，在开头添加From头
-			if !inserted {
-				newLinesWithFrom = append([]string{fmt.Sprintf("From: %s", from)}, newLines...)
-			}
-
-			newLines = newLinesWithFrom
-		}
-
-		// 如果没有替换To头，添加一个
-		if !toReplaced {
-			// 找到第一个空行前插入To头
-			inserted := false
-			newLinesWith := []string{}
-
-			for _, line := range newLines {
-				if line == "" && !inserted {
-					newLinesWith = append(newLinesWith, fmt.Sprintf("To: %s", buildAddressList(email.To)))
-					inserted = true
-				}
-				newLinesWith = append(newLinesWith, line)
-			}
-
-			// 如果没有空行，在开头添加To头
-			if !inserted {
-				newLinesWith = append([]string{fmt.Sprintf("To: %s", buildAddressList(email.To))}, newLines...)
-			}
-
-			newLines = newLinesWith
-		}
-
-		message = strings.Join(newLines, "\r\n")
+	var content string
+	header, rest := message.SplitHeader(email.Body)
+	if header != "" {
+		// 邮件内容已经包含头部，替换或添加From和To头，其余头部保持不变
+		header = message.SetHeader(header, "From", from)
+		header = message.SetHeader(header, "To", buildAddressList(email.To))
+		content = header + rest
 	} else {
 		// 构建完整的邮件，包括头部
 		header := make(map[string]string)
@@ -247,156 +292,268 @@ func (w *Worker) sendEmail(email *db.Email) error {
 		header["Content-Transfer-Encoding"] = "8bit"
 		header["Date"] = time.Now().Format(time.RFC1123Z)
 
-		message = ""
+		content = ""
 		for k, v := range header {
-			message += fmt.Sprintf("%s: %s\r\n", k, v)
+			content += fmt.Sprintf("%s: %s\r\n", k, v)
 		}
-		message += "\r\n" + email.Body
+		content += "\r\n" + email.Body
 	}
 
-	// 根据加密方式发送邮件
-	switch w.config.SMTPEncryption {
-	case "tls":
-		return w.sendMailWithTLS(smtpAddr, auth, from, email.To, []byte(message))
-	case "ssl":
-		return w.sendMailWithSSL(smtpAddr, auth, from, email.To, []byte(message))
-	default:
-		// 无加密
-		return smtp.SendMail(smtpAddr, auth, from, email.To, []byte(message))
-	}
+	return w.deliver(smtpAddr, auth, from, email, []byte(content))
 }
 
-// 使用TLS发送邮件（先连接后加密）
-func (w *Worker) sendMailWithTLS(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+// 连接上游SMTP服务器并投递邮件
+//
+// 加密方式：ssl 直接使用TLS连接；tls 先连接后通过STARTTLS加密；
+// none 不强制加密，与smtp.SendMail一致，服务器支持时仍会尝试STARTTLS。
+//
+// 每个收件人的RCPT结果分别记录：rcptErrors为被上游拒绝或无法投递的收件人（email.To中的下标）
+// 及其错误，邮件内容只发给其余收件人。err不为nil时整封邮件投递失败，没有收件人投递成功。
+func (w *Worker) deliver(addr string, auth smtp.Auth, from string, email *db.Email, msg []byte) (rcptErrors map[int]error, err error) {
 	// 解析服务器地址
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// 先连接到服务器
-	conn, err := net.Dial("tcp", addr)
+	// TLS配置
+	tlsConfig := &tls.Config{
+		ServerName: host,
+	}
+
+	// 整个投递过程（连接、握手和全部命令）必须在租约到期前完成
+	deadline := time.Now().Add(w.config.DeliveryTimeout)
+	dialer := &net.Dialer{Deadline: deadline}
+
+	var conn net.Conn
+	if w.config.SMTPEncryption == "ssl" {
+		// 直接使用TLS连接
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		// 先连接到服务器
+		conn, err = dialer.Dial("tcp", addr)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer conn.Close()
 
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// 建立会话时的错误（包括上游的5xx响应）通常来自配置或上游服务器的状态，与邮件本身无关，
+	// 不保留响应码，使其按暂时性错误重试
+
 	// 创建SMTP客户端
 	client, err := smtp.NewClient(conn, host)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("连接上游服务器时出错: %v", err)
 	}
 	defer client.Close()
 
 	// 开始TLS加密
-	tlsConfig := &tls.Config{
-		ServerName: host,
-	}
-	if err = client.StartTLS(tlsConfig); err != nil {
-		return err
+	switch w.config.SMTPEncryption {
+	case "tls":
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return nil, fmt.Errorf("STARTTLS失败: %v", err)
+		}
+	case "none":
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err = client.StartTLS(tlsConfig); err != nil {
+				return nil, fmt.Errorf("STARTTLS失败: %v", err)
+			}
+		}
 	}
 
 	// 认证
 	if auth != nil {
 		if err = client.Auth(auth); err != nil {
-			return err
+			return nil, fmt.Errorf("上游服务器认证失败: %v", err)
+		}
+	}
+
+	// 上游不支持SMTPUTF8时，将信封地址的域名转换为IDNA的ASCII形式
+	smtputf8, _ := client.Extension("SMTPUTF8")
+	if !smtputf8 {
+		if from, err = asciiAddress(from); err != nil {
+			return nil, err
+		}
+	}
+
+	// 二进制内容只能通过BDAT传输
+	binary := email.BodyType == "BINARYMIME"
+	if binary {
+		if ok, _ := client.Extension("CHUNKING"); !ok {
+			return nil, permanentf("上游服务器不支持CHUNKING，无法投递二进制邮件")
+		}
+		if ok, _ := client.Extension("BINARYMIME"); !ok {
+			return nil, permanentf("上游服务器不支持BINARYMIME，无法投递二进制邮件")
 		}
 	}
 
 	// 设置发件人
-	if err = client.Mail(from); err != nil {
-		return err
+	if err = command(client, 250, "MAIL FROM:<%s>%s", from, mailParams(client, email)); err != nil {
+		return nil, err
 	}
 
-	// 设置收件人
-	for _, addr := range to {
-		if err = client.Rcpt(addr); err != nil {
-			return err
+	// 设置收件人，上游拒绝的收件人记录后继续处理其余收件人
+	rcptErrors = make(map[int]error)
+	for i, addr := range email.To {
+		if !smtputf8 {
+			if addr, err = asciiAddress(addr); err != nil {
+				rcptErrors[i] = err
+				continue
+			}
+		}
+
+		err = command(client, 25, "RCPT TO:<%s>", addr)
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			rcptErrors[i] = err
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	// 发送邮件主体
-	writer, err := client.Data()
+	// 没有收件人被接受时不发送邮件内容
+	if len(rcptErrors) == len(email.To) {
+		client.Quit()
+		return rcptErrors, nil
+	}
+
+	if binary {
+		err = transmitBinary(client, msg)
+	} else {
+		err = transmitData(client, msg)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = writer.Write(msg)
+	return rcptErrors, client.Quit()
+}
+
+// 构建上游MAIL FROM命令的ESMTP参数
+//
+// 客户端的DSN参数（RET、ENVID、NOTIFY、ORCPT）不转发给上游：信封发件人始终为SMTP_FROM，
+// 上游生成的投递状态通知不会到达原始发件人，客户端要求的通知由队列自己生成
+func mailParams(client *smtp.Client, email *db.Email) string {
+	var params []string
+
+	// 与net/smtp的Client.Mail一致，上游支持时声明8BITMIME和SMTPUTF8
+	if email.BodyType == "BINARYMIME" {
+		params = append(params, "BODY=BINARYMIME")
+	} else if ok, _ := client.Extension("8BITMIME"); ok {
+		params = append(params, "BODY=8BITMIME")
+	}
+	if ok, _ := client.Extension("SMTPUTF8"); ok {
+		params = append(params, "SMTPUTF8")
+	}
+
+	if len(params) == 0 {
+		return ""
+	}
+	return " " + strings.Join(params, " ")
+}
+
+// 使用DATA命令发送邮件主体
+func transmitData(client *smtp.Client, msg []byte) error {
+	writer, err := client.Data()
 	if err != nil {
 		return err
 	}
 
-	err = writer.Close()
+	_, err = writer.Write(msg)
 	if err != nil {
 		return err
 	}
 
-	return client.Quit()
+	return writer.Close()
 }
 
-// 使用SSL发送邮件（直接使用TLS连接）
-func (w *Worker) sendMailWithSSL(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
-	// 解析服务器地址
-	host, _, err := net.SplitHostPort(addr)
+// 使用BDAT（RFC 3030）发送BODY=BINARYMIME的邮件主体
+func transmitBinary(client *smtp.Client, msg []byte) error {
+	// 整封邮件作为最后一个数据块发送
+	id, err := client.Text.Cmd("BDAT %d LAST", len(msg))
 	if err != nil {
 		return err
 	}
-
-	// TLS配置
-	tlsConfig := &tls.Config{
-		ServerName: host,
+	if _, err := client.Text.W.Write(msg); err != nil {
+		return err
 	}
-
-	// 直接使用TLS连接
-	conn, err := tls.Dial("tcp", addr, tlsConfig)
-	if err != nil {
+	if err := client.Text.W.Flush(); err != nil {
 		return err
 	}
-	defer conn.Close()
 
-	// 创建SMTP客户端
-	client, err := smtp.NewClient(conn, host)
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	_, _, err = client.Text.ReadResponse(250)
+	return err
+}
+
+// 向上游服务器发送一条命令并检查响应码
+//
+// 用于net/smtp没有直接提供的命令或参数。
+func command(client *smtp.Client, expectCode int, format string, args ...any) error {
+	id, err := client.Text.Cmd(format, args...)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
 
-	// 认证
-	if auth != nil {
-		if err = client.Auth(auth); err != nil {
-			return err
-		}
-	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	_, _, err = client.Text.ReadResponse(expectCode)
+	return err
+}
 
-	// 设置发件人
-	if err = client.Mail(from); err != nil {
-		return err
-	}
+// permanentError 是本地判定的永久性错误，例如上游服务器不支持投递邮件所需的扩展
+type permanentError struct {
+	err error
+}
 
-	// 设置收件人
-	for _, addr := range to {
-		if err = client.Rcpt(addr); err != nil {
-			return err
-		}
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// 生成永久性错误
+func permanentf(format string, args ...any) error {
+	return &permanentError{err: fmt.Errorf(format, args...)}
+}
+
+// 判断是否为永久性错误，重试不会成功：上游服务器对邮件事务命令的5xx响应，或本地判定的永久性错误
+func isPermanent(err error) bool {
+	var pErr *permanentError
+	if errors.As(err, &pErr) {
+		return true
 	}
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && tpErr.Code >= 500
+}
 
-	// 发送邮件主体
-	writer, err := client.Data()
-	if err != nil {
-		return err
+// 将地址的域名转换为IDNA的ASCII形式（A-label）
+//
+// 本地部分不存在ASCII表示，包含非ASCII字符时只能投递给支持SMTPUTF8的服务器。
+func asciiAddress(addr string) (string, error) {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return addr, nil
 	}
 
-	_, err = writer.Write(msg)
-	if err != nil {
-		return err
+	local, domain := addr[:at], addr[at+1:]
+	for i := 0; i < len(local); i++ {
+		if local[i] >= 0x80 {
+			return "", permanentf("上游服务器不支持SMTPUTF8，无法投递到非ASCII地址 %s", addr)
+		}
 	}
 
-	err = writer.Close()
+	asciiDomain, err := idna.Lookup.ToASCII(domain)
 	if err != nil {
-		return err
+		return "", permanentf("无法转换域名 %s: %w", domain, err)
 	}
-
-	return client.Quit()
+	return local + "@" + asciiDomain, nil
 }
 
 // 构建地址列表
@@ -0,0 +1,439 @@
+package worker
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivampiresp/smtp-queue/config"
+	"github.com/ivampiresp/smtp-queue/db"
+)
+
+// fakeUpstream 是测试用的上游SMTP服务器，按预设的响应回复命令并记录收到的邮件
+type fakeUpstream struct {
+	extensions  []string          // EHLO通告的扩展
+	authReply   string            // AUTH的响应，默认235
+	rcptReplies map[string]string // 收件人对应的RCPT响应，未列出的收件人返回250
+	dataReply   string            // 邮件内容结束后的响应，默认250
+
+	mu         sync.Mutex
+	recipients []string // 最后一个事务中被接受的收件人
+	messages   []string // 收到的邮件内容
+	commands   []string
+}
+
+// 在本机随机端口上启动上游服务器，返回指向它的工作者配置
+func (u *fakeUpstream) start(t *testing.T) *config.Config {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(conn)
+		}
+	}()
+
+	return &config.Config{
+		Hostname:        "relay.test",
+		WorkerID:        "worker-test",
+		LeaseDuration:   time.Minute,
+		DeliveryTimeout: 10 * time.Second,
+		MaxEmailAge:     72 * time.Hour,
+		MaxFailCount:    3,
+		SMTPHost:        "127.0.0.1",
+		SMTPPort:        ln.Addr().(*net.TCPAddr).Port,
+		SMTPFrom:        "relay@relay.test",
+		SMTPEncryption:  "none",
+	}
+}
+
+func (u *fakeUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(conn)
+
+	c.PrintfLine("220 upstream.test ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		u.mu.Lock()
+		u.commands = append(u.commands, line)
+		u.mu.Unlock()
+
+		verb, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			lines := append([]string{"upstream.test"}, u.extensions...)
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				c.PrintfLine("250%s%s", sep, l)
+			}
+		case "AUTH":
+			c.PrintfLine("%s", reply(u.authReply, "235 2.7.0 Authentication successful"))
+		case "MAIL":
+			u.mu.Lock()
+			u.recipients = nil
+			u.mu.Unlock()
+			c.PrintfLine("250 2.1.0 Ok")
+		case "RCPT":
+			addr := args[strings.Index(args, "<")+1 : strings.Index(args, ">")]
+			r := reply(u.rcptReplies[addr], "250 2.1.5 Ok")
+			if strings.HasPrefix(r, "250") {
+				u.mu.Lock()
+				u.recipients = append(u.recipients, addr)
+				u.mu.Unlock()
+			}
+			c.PrintfLine("%s", r)
+		case "DATA":
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			u.received(string(data))
+		case "BDAT":
+			size, _ := strconv.Atoi(strings.Fields(args)[0])
+			data := make([]byte, size)
+			if _, err := io.ReadFull(c.R, data); err != nil {
+				return
+			}
+			u.received(string(data))
+		case "QUIT":
+			c.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			c.PrintfLine("502 5.5.1 Command not implemented")
+		}
+		if strings.EqualFold(verb, "DATA") || strings.EqualFold(verb, "BDAT") {
+			c.PrintfLine("%s", reply(u.dataReply, "250 2.0.0 Ok: queued"))
+		}
+	}
+}
+
+// 记录收到的邮件内容
+func (u *fakeUpstream) received(data string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.messages = append(u.messages, data)
+}
+
+// 返回收到的邮件数和最后一个事务中被接受的收件人
+func (u *fakeUpstream) delivered() (int, []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.messages), slices.Clone(u.recipients)
+}
+
+// 返回以prefix开头的命令
+func (u *fakeUpstream) command(prefix string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var result []string
+	for _, cmd := range u.commands {
+		if strings.HasPrefix(cmd, prefix) {
+			result = append(result, cmd)
+		}
+	}
+	return result
+}
+
+func reply(r, defaultReply string) string {
+	if r == "" {
+		return defaultReply
+	}
+	return r
+}
+
+func testEmail(to []string, rcptParams []string) *db.Email {
+	return &db.Email{
+		From:       "sender@client.test",
+		To:         to,
+		Subject:    "test",
+		Body:       "Subject: test\r\nMessage-ID: <1@client.test>\r\n\r\nbody\r\n",
+		RcptParams: rcptParams,
+	}
+}
+
+// 创建使用内存队列的工作者并加入待投递的邮件
+func newTestWorker(t *testing.T, cfg *config.Config, email *db.Email) *Worker {
+	t.Helper()
+
+	store := db.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	if err := store.Enqueue(email); err != nil {
+		t.Fatal(err)
+	}
+	return New(store, cfg)
+}
+
+// 返回队列中的邮件，投递状态报告（空反向路径）单独返回
+func (w *Worker) queued(t *testing.T) (pending, reports []*db.Email) {
+	t.Helper()
+
+	emails, err := w.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range emails {
+		if email.From == "" {
+			reports = append(reports, email)
+		} else {
+			pending = append(pending, email)
+		}
+	}
+	return pending, reports
+}
+
+func TestDeliverySuccess(t *testing.T) {
+	upstream := &fakeUpstream{extensions: []string{"8BITMIME"}}
+	w := newTestWorker(t, upstream.start(t), testEmail([]string{"a@example.test", "b@example.test"}, []string{"NOTIFY=SUCCESS", ""}))
+
+	w.processQueue()
+
+	if count, rcpts := upstream.delivered(); count != 1 || !slices.Equal(rcpts, []string{"a@example.test", "b@example.test"}) {
+		t.Fatalf("上游收到 %d 封邮件，收件人 %v", count, rcpts)
+	}
+	pending, reports := w.queued(t)
+	if len(pending) != 0 {
+		t.Errorf("投递成功后邮件仍在队列中: %+v", pending[0])
+	}
+	// 只有要求NOTIFY=SUCCESS的收件人收到转发成功通知
+	if len(reports) != 1 || !strings.Contains(reports[0].Body, "Action: relayed") ||
+		!strings.Contains(reports[0].Body, "<a@example.test>") || strings.Contains(reports[0].Body, "b@example.test") {
+		t.Errorf("投递状态报告 = %q", bodies(reports))
+	}
+}
+
+func TestPartialRecipientFailure(t *testing.T) {
+	upstream := &fakeUpstream{rcptReplies: map[string]string{
+		"bounce@example.test": "550 5.1.1 User unknown",
+		"retry@example.test":  "451 4.3.0 Try again later",
+	}}
+	w := newTestWorker(t, upstream.start(t), testEmail(
+		[]string{"ok@example.test", "bounce@example.test", "retry@example.test"},
+		[]string{"", "", "NOTIFY=NEVER"}))
+
+	w.processQueue()
+
+	// 邮件内容只发给被接受的收件人
+	if count, rcpts := upstream.delivered(); count != 1 || !slices.Equal(rcpts, []string{"ok@example.test"}) {
+		t.Fatalf("上游收到 %d 封邮件，收件人 %v", count, rcpts)
+	}
+
+	// 暂时拒绝的收件人留在队列中重试，其余收件人被移除
+	pending, reports := w.queued(t)
+	if len(pending) != 1 {
+		t.Fatalf("队列中有 %d 封待投递邮件，期望1封", len(pending))
+	}
+	if got := pending[0]; !slices.Equal(got.To, []string{"retry@example.test"}) || !slices.Equal(got.RcptParams, []string{"NOTIFY=NEVER"}) ||
+		got.FailCount != 1 || !strings.Contains(got.LastError, "451 4.3.0") {
+		t.Errorf("待重试的邮件 = %+v", got)
+	}
+
+	// 永久拒绝的收件人立即退信
+	if len(reports) != 1 {
+		t.Fatalf("生成了 %d 份投递状态报告，期望1份", len(reports))
+	}
+	body := reports[0].Body
+	if !strings.Contains(body, "Final-Recipient: rfc822; bounce@example.test\r\nAction: failed\r\nStatus: 5.1.1\r\n") ||
+		!strings.Contains(body, "Diagnostic-Code: smtp; 550 5.1.1 User unknown") ||
+		strings.Contains(body, "ok@example.test") || strings.Contains(body, "retry@example.test") {
+		t.Errorf("退信内容 = %q", body)
+	}
+}
+
+func TestAllRecipientsRejected(t *testing.T) {
+	upstream := &fakeUpstream{rcptReplies: map[string]string{
+		"a@example.test": "550 5.1.1 User unknown",
+		"b@example.test": "553 5.1.3 Bad address",
+	}}
+	w := newTestWorker(t, upstream.start(t), testEmail([]string{"a@example.test", "b@example.test"}, nil))
+
+	w.processQueue()
+
+	if count, _ := upstream.delivered(); count != 0 {
+		t.Errorf("没有收件人被接受时仍发送了邮件内容")
+	}
+	pending, reports := w.queued(t)
+	if len(pending) != 0 {
+		t.Errorf("全部收件人被拒绝后邮件仍在队列中")
+	}
+	if len(reports) != 1 || !strings.Contains(reports[0].Body, "Status: 5.1.1") || !strings.Contains(reports[0].Body, "Status: 5.1.3") {
+		t.Errorf("投递状态报告 = %q", bodies(reports))
+	}
+}
+
+func TestTemporaryFailureRetries(t *testing.T) {
+	upstream := &fakeUpstream{dataReply: "451 4.3.0 Mail server temporarily rejected message"}
+	cfg := upstream.start(t)
+	cfg.MaxFailCount = 2
+	w := newTestWorker(t, cfg, testEmail([]string{"a@example.test", "b@example.test"}, nil))
+
+	w.processQueue()
+
+	pending, reports := w.queued(t)
+	if len(pending) != 1 || pending[0].FailCount != 1 || len(pending[0].To) != 2 || pending[0].LeaseOwner != "" {
+		t.Fatalf("暂时失败后的邮件 = %+v", pending)
+	}
+	if len(reports) != 0 {
+		t.Errorf("暂时失败不应通知发件人: %q", bodies(reports))
+	}
+
+	// 失败次数达到上限后放弃投递并退信
+	w.processQueue()
+
+	pending, reports = w.queued(t)
+	if len(pending) != 0 {
+		t.Errorf("失败次数达到上限后邮件仍在队列中")
+	}
+	if len(reports) != 1 || strings.Count(reports[0].Body, "Action: failed") != 2 || !strings.Contains(reports[0].Body, "Status: 5.0.0") {
+		t.Errorf("投递状态报告 = %q", bodies(reports))
+	}
+}
+
+func TestPermanentFailureBounces(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream *fakeUpstream
+		bodyType string
+		rcpt     string
+		status   string
+		sent     int // 上游收到的邮件数
+	}{
+		{"DATA", &fakeUpstream{dataReply: "554 5.6.0 Message rejected"}, "", "a@example.test", "Status: 5.6.0", 1},
+		{"CHUNKING", &fakeUpstream{}, "BINARYMIME", "a@example.test", "CHUNKING", 0},
+		{"BINARYMIME", &fakeUpstream{extensions: []string{"CHUNKING"}}, "BINARYMIME", "a@example.test", "BINARYMIME", 0},
+		{"SMTPUTF8", &fakeUpstream{}, "", "用户@example.test", "SMTPUTF8", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := testEmail([]string{tt.rcpt}, nil)
+			email.BodyType = tt.bodyType
+			w := newTestWorker(t, tt.upstream.start(t), email)
+
+			w.processQueue()
+
+			pending, reports := w.queued(t)
+			if len(pending) != 0 {
+				t.Errorf("永久失败后邮件仍在队列中: %+v", pending[0])
+			}
+			if len(reports) != 1 || !strings.Contains(reports[0].Body, tt.status) {
+				t.Errorf("投递状态报告 = %q", bodies(reports))
+			}
+			if count, _ := tt.upstream.delivered(); count != tt.sent {
+				t.Errorf("上游收到了 %d 封邮件", count)
+			}
+		})
+	}
+}
+
+func TestUpstreamAuthFailureIsTemporary(t *testing.T) {
+	upstream := &fakeUpstream{extensions: []string{"AUTH PLAIN"}, authReply: "535 5.7.8 Authentication credentials invalid"}
+	cfg := upstream.start(t)
+	cfg.SMTPUsername = "relay"
+	cfg.SMTPPassword = "wrong"
+	w := newTestWorker(t, cfg, testEmail([]string{"a@example.test"}, nil))
+
+	w.processQueue()
+
+	// 上游拒绝认证是配置问题，与邮件无关，不退信
+	pending, reports := w.queued(t)
+	if len(pending) != 1 || pending[0].FailCount != 1 {
+		t.Errorf("认证失败后的邮件 = %+v", pending)
+	}
+	if len(reports) != 0 {
+		t.Errorf("认证失败不应退信: %q", bodies(reports))
+	}
+	if len(upstream.command("MAIL")) != 0 {
+		t.Error("认证失败后仍发送了MAIL FROM")
+	}
+}
+
+func TestDelayNotification(t *testing.T) {
+	upstream := &fakeUpstream{rcptReplies: map[string]string{
+		"a@example.test": "452 4.2.2 Mailbox full",
+		"b@example.test": "452 4.2.2 Mailbox full",
+	}}
+	cfg := upstream.start(t)
+	cfg.DelayWarningTime = time.Nanosecond
+	w := newTestWorker(t, cfg, testEmail([]string{"a@example.test", "b@example.test"}, []string{"NOTIFY=DELAY,FAILURE", ""}))
+
+	w.processQueue()
+
+	pending, reports := w.queued(t)
+	if len(pending) != 1 || !pending[0].DelayNotified {
+		t.Fatalf("延迟通知后的邮件 = %+v", pending)
+	}
+	// 只有要求NOTIFY=DELAY的收件人收到延迟通知
+	if len(reports) != 1 || !strings.Contains(reports[0].Body, "Action: delayed\r\nStatus: 4.2.2") ||
+		strings.Contains(reports[0].Body, "b@example.test") {
+		t.Fatalf("投递状态报告 = %q", bodies(reports))
+	}
+
+	// 每封邮件只通知一次：再次处理队列时投递已生成的通知，不再生成新的通知
+	w.processQueue()
+	if count, _ := upstream.delivered(); count != 1 {
+		t.Errorf("上游收到 %d 封邮件，期望只有延迟通知", count)
+	}
+	if _, reports := w.queued(t); len(reports) != 0 {
+		t.Errorf("重复生成了延迟通知: %q", bodies(reports))
+	}
+}
+
+// 检查投递状态报告是否可以被解析为邮件
+func TestReportIsValidMessage(t *testing.T) {
+	upstream := &fakeUpstream{dataReply: "554 5.6.0 Message rejected"}
+	w := newTestWorker(t, upstream.start(t), testEmail([]string{"a@example.test"}, nil))
+
+	w.processQueue()
+
+	_, reports := w.queued(t)
+	if len(reports) != 1 {
+		t.Fatalf("生成了 %d 份投递状态报告，期望1份", len(reports))
+	}
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(reports[0].Body)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("To"); got != "sender@client.test" {
+		t.Errorf("To = %q", got)
+	}
+	if !strings.HasPrefix(header.Get("Content-Type"), "multipart/report; report-type=delivery-status") {
+		t.Errorf("Content-Type = %q", header.Get("Content-Type"))
+	}
+	if !slices.Equal(reports[0].To, []string{"sender@client.test"}) {
+		t.Errorf("报告收件人 = %v", reports[0].To)
+	}
+}
+
+func bodies(emails []*db.Email) []string {
+	var result []string
+	for _, email := range emails {
+		result = append(result, email.Body)
+	}
+	return result
+}